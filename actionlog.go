@@ -0,0 +1,48 @@
+package hierarchicalStateMachine
+
+import "sync"
+
+// DefaultActionLogCap is how many entries WithActionLog keeps unless WithActionLogCap says otherwise
+const DefaultActionLogCap = 1024
+
+// ActionEntry describes one executed action
+type ActionEntry struct {
+	Phase Phase
+	State StateName // The state the action belongs to, the source state for transition actions
+}
+
+// actionLog keeps the most recent entries up to its cap
+type actionLog struct {
+	mu      sync.Mutex // ParallelEntry actions log from several goroutines
+	entries []ActionEntry
+	cap     int
+}
+
+// Returns the action wrapped to record itself when it runs, or the action itself when not logging
+func (sm *HierarchicalStateMachine) logged(phase Phase, state *State, action Action) Action {
+	if sm.actionLog == nil {
+		return action
+	}
+	log := sm.actionLog
+	entry := ActionEntry{Phase: phase, State: stateName(state)}
+	return func() {
+		log.mu.Lock()
+		if log.cap > 0 && len(log.entries) == log.cap {
+			log.entries = append(log.entries[:0], log.entries[1:]...)
+		}
+		log.entries = append(log.entries, entry)
+		log.mu.Unlock()
+		action()
+	}
+}
+
+// ActionLog returns a copy of the actions executed since the log was enabled, oldest first. Only
+// the most recent entries are kept once the cap is reached. It is empty without WithActionLog.
+func (sm *HierarchicalStateMachine) ActionLog() []ActionEntry {
+	if sm.actionLog == nil {
+		return nil
+	}
+	sm.actionLog.mu.Lock()
+	defer sm.actionLog.mu.Unlock()
+	return append([]ActionEntry(nil), sm.actionLog.entries...)
+}
@@ -0,0 +1,63 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestActionLog(t *testing.T) {
+	noop := func() {}
+
+	parentA := State{Name: "parentA", Entry: []Action{noop}, Exit: []Action{noop}}
+	stateA := State{Name: "stateA", ParentState: &parentA, Entry: []Action{noop}, Exit: []Action{noop}}
+	parentB := State{Name: "parentB", Entry: []Action{noop}, Exit: []Action{noop}}
+	stateB := State{Name: "stateB", ParentState: &parentB, Entry: []Action{noop}}
+
+	transitions := []Transition{{CurrentState: &stateA, Actions: []Action{noop}, NextState: &stateB}}
+
+	sm, err := NewHierarchicalStateMachine(&stateA, []State{parentA, stateA, parentB, stateB}, transitions, WithActionLog())
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	HandleStateMachine(sm)
+
+	// Check the initial entry, then the exact Exit/transition/Entry sequence
+	expected := []ActionEntry{
+		{PhaseEntry, "parentA"},
+		{PhaseEntry, "stateA"},
+		{PhaseExit, "stateA"},
+		{PhaseExit, "parentA"},
+		{PhaseTransition, "stateA"},
+		{PhaseEntry, "parentB"},
+		{PhaseEntry, "stateB"},
+	}
+	if log := sm.ActionLog(); !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected action log %v, got %v", expected, log)
+	}
+}
+
+func TestActionLogCap(t *testing.T) {
+	noop := func() {}
+
+	state1 := State{Name: "state1", Entry: []Action{noop}}
+	state2 := State{Name: "state2", Entry: []Action{noop}}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithActionLogCap(2))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		HandleStateMachine(sm)
+	}
+
+	// Check only the most recent entries are kept
+	expected := []ActionEntry{{PhaseEntry, "state1"}, {PhaseEntry, "state2"}}
+	if log := sm.ActionLog(); !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected action log %v, got %v", expected, log)
+	}
+}
@@ -0,0 +1,19 @@
+package hierarchicalStateMachine
+
+// Conditional returns an action that runs action only if pred is true when it executes
+func Conditional(pred Predicate, action Action) Action {
+	return func() {
+		if pred() {
+			action()
+		}
+	}
+}
+
+// ActionExecutor runs the machine's actions, such as on a UI thread or with instrumentation. Run
+// is called once per action, in the order the machine would run them inline, and the action's
+// PanicPolicy and action log entry are applied inside the action it is given. The Entry actions
+// of a ParallelEntry state are the exception: Run is called for each of them concurrently, from
+// separate goroutines.
+type ActionExecutor interface {
+	Run(action Action)
+}
@@ -0,0 +1,85 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConditional(t *testing.T) {
+	resetExecutedActions()
+
+	verbose := false
+	state1 := State{}
+	state2 := State{
+		Entry: []Action{
+			recordAction("State 2 Entry"),
+			Conditional(FieldTrue(&verbose), recordAction("State 2 Verbose Entry")),
+		},
+	}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the conditional action is skipped while the predicate is false
+	HandleStateMachine(sm)
+	expectedActions := []string{"State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check it runs once the predicate is true at execution time
+	resetExecutedActions()
+	verbose = true
+	HandleStateMachine(sm)
+	HandleStateMachine(sm)
+	expectedActions = []string{"State 2 Entry", "State 2 Verbose Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+// recordingExecutor records a marker before running each action inline
+type recordingExecutor struct{}
+
+func (recordingExecutor) Run(action Action) {
+	executedActions = append(executedActions, "Executor")
+	action()
+}
+
+func TestWithExecutor(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{
+		Entry: []Action{recordAction("State 1 Entry")},
+		Exit:  []Action{recordAction("State 1 Exit")},
+	}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+
+	transitions := []Transition{
+		{CurrentState: &state1, Actions: []Action{recordAction("State 1 -> State 2 Transition")}, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithExecutor(recordingExecutor{}))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check every action went through the executor in order
+	HandleStateMachine(sm)
+	expectedActions := []string{
+		"Executor", "State 1 Entry",
+		"Executor", "State 1 Exit",
+		"Executor", "State 1 -> State 2 Transition",
+		"Executor", "State 2 Entry",
+	}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
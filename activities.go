@@ -0,0 +1,61 @@
+package hierarchicalStateMachine
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultActivityStopTimeout is how long exiting a state waits for its DoActivity to return
+const DefaultActivityStopTimeout = time.Second
+
+// activity is a running DoActivity of an entered state
+type activity struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Launches the state's DoActivity, as an action so it is buffered or dropped like the Entry actions
+func (sm *HierarchicalStateMachine) startActivity(state *State) {
+	if state.DoActivity == nil {
+		return
+	}
+	sm.execute(PhaseEntry, state, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			state.DoActivity(ctx)
+		}()
+
+		if sm.activities == nil {
+			sm.activities = map[*State]activity{}
+		}
+		// A state entered again without being exited would otherwise lose its running activity
+		if running, ok := sm.activities[state]; ok {
+			running.cancel()
+		}
+		sm.activities[state] = activity{cancel: cancel, done: done}
+	})
+}
+
+// Cancels the state's running DoActivity and waits for it to return, up to the stop timeout
+func (sm *HierarchicalStateMachine) stopActivity(state *State) {
+	if state.DoActivity == nil {
+		return
+	}
+	sm.execute(PhaseExit, state, func() {
+		running, ok := sm.activities[state]
+		if !ok {
+			return
+		}
+		delete(sm.activities, state)
+		running.cancel()
+
+		timer := time.NewTimer(sm.activityStopTimeout)
+		defer timer.Stop()
+		select {
+		case <-running.done:
+		case <-timer.C:
+		}
+	})
+}
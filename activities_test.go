@@ -0,0 +1,118 @@
+package hierarchicalStateMachine
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDoActivity(t *testing.T) {
+	started := make(chan struct{})
+	var cancelled bool
+
+	state1 := State{
+		DoActivity: func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			cancelled = true
+		},
+	}
+	state2 := State{}
+
+	leave := false
+	transitions := []Transition{
+		{CurrentState: &state1, Guards: []Predicate{func() bool { return leave }}, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the activity to start on entry")
+	}
+
+	// Check exiting cancels the activity and waits for it to return
+	leave = true
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+	if !cancelled {
+		t.Errorf("Expected the activity's context to be cancelled on exit")
+	}
+}
+
+func TestDoActivityStopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	state1 := State{DoActivity: func(ctx context.Context) { <-release }}
+	state2 := State{}
+
+	transitions := []Transition{{CurrentState: &state1, NextState: &state2}}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithActivityStopTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check an activity ignoring cancellation doesn't block the exit past the timeout
+	start := time.Now()
+	HandleStateMachine(sm)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected exit to give up after the stop timeout, took %v", elapsed)
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestDoActivitySkipExit(t *testing.T) {
+	started := make(chan struct{}, 2)
+	cancelled := make(chan struct{}, 2)
+
+	state1 := State{
+		DoActivity: func(ctx context.Context) {
+			started <- struct{}{}
+			<-ctx.Done()
+			cancelled <- struct{}{}
+		},
+	}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "skip", SkipExit: true, NextState: &state2},
+		{CurrentState: &state2, EventName: "back", NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	<-started
+
+	// Check skipping the Exit actions still cancels the activity
+	sm.SendEvent("skip")
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the activity to be cancelled on leaving the state")
+	}
+	if _, ok := sm.activities[&state1]; ok {
+		t.Errorf("Expected the activity to be forgotten once stopped")
+	}
+
+	// Check the activity started on re-entry can be cancelled
+	sm.SendEvent("back")
+	<-started
+	sm.SendEvent("skip")
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the re-entered activity to be cancelled on leaving the state")
+	}
+}
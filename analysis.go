@@ -0,0 +1,496 @@
+package hierarchicalStateMachine
+
+import "sort"
+
+// EmptyStates returns states with no Entry, Exit or Handle actions that no transition
+// references, which usually means the model is unfinished. Composite states are not
+// reported since their children give them meaning. Declared states the machine can't reach
+// through its transitions are matched by name, as Validate does, so only named ones are found.
+func (sm *HierarchicalStateMachine) EmptyStates() []*State {
+	states := sm.States()
+	candidates := append([]*State(nil), states...)
+	known := map[StateName]bool{}
+	for _, state := range states {
+		known[state.Name] = true
+	}
+	for i := range sm.states {
+		if name := sm.states[i].Name; name != "" && !known[name] {
+			candidates = append(candidates, &sm.states[i])
+		}
+	}
+
+	var empty []*State
+	for _, state := range candidates {
+		if len(state.Entry) > 0 || len(state.Exit) > 0 || len(state.Handle) > 0 {
+			continue
+		}
+		if sm.isReferenced(state) || isParentOfAny(state, states) {
+			continue
+		}
+		empty = append(empty, state)
+	}
+	return empty
+}
+
+// Reports whether any transition starts or ends in the state
+func (sm *HierarchicalStateMachine) isReferenced(state *State) bool {
+	for i := range sm.transitions {
+		if sm.transitions[i].CurrentState == state || sm.transitions[i].NextState == state {
+			return true
+		}
+	}
+	return false
+}
+
+func isParentOfAny(state *State, states []*State) bool {
+	for _, other := range states {
+		if other.ParentState == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Depth returns 0 for a root state and one more for every ParentState level above it. The walk
+// is bounded by MaxStates so a cyclic hierarchy cannot hang it.
+func (s *State) Depth() int {
+	depth := 0
+	for parent := s.ParentState; parent != nil && depth < MaxStates; parent = parent.ParentState {
+		depth++
+	}
+	return depth
+}
+
+// CurrentDepth returns the depth of the current state in the hierarchy
+func (sm *HierarchicalStateMachine) CurrentDepth() int {
+	if sm.CurrentState == nil {
+		return 0
+	}
+	return sm.CurrentState.Depth()
+}
+
+// PlanTransition returns the ordered phases the transition would execute, such as
+// "exit state1", "actions" and "enter state2", without running anything
+func (sm *HierarchicalStateMachine) PlanTransition(t *Transition) []string {
+	commonAncestor := findCommonAncestor(t.CurrentState, t.NextState)
+
+	var plan []string
+	for state := t.CurrentState; state != commonAncestor && !t.SkipExit; state = state.ParentState {
+		plan = append(plan, "exit "+string(state.Name))
+	}
+	plan = append(plan, "actions")
+
+	if !t.SkipEntry {
+		plan = append(plan, planEntry(t.NextState, commonAncestor)...)
+		state := t.NextState
+		for i := 0; i < MaxStates; i++ {
+			child := initialDescendant(state)
+			if child == nil {
+				break
+			}
+			plan = append(plan, planEntry(child, state)...)
+			state = child
+		}
+	}
+
+	if t.OnComplete != nil {
+		plan = append(plan, "complete")
+	}
+	return plan
+}
+
+// WithCurrentState runs fn as if the machine were in s, for what-if analysis with read-only
+// queries such as ExitSetFor or ReachableWithin. No Entry or Exit actions run, and the original
+// current state is restored afterwards, even if fn panics. fn must not dispatch events.
+func (sm *HierarchicalStateMachine) WithCurrentState(s *State, fn func()) {
+	sm.mu.Lock()
+	original := sm.CurrentState
+	sm.CurrentState = s
+	sm.mu.Unlock()
+
+	defer func() {
+		sm.mu.Lock()
+		sm.CurrentState = original
+		sm.mu.Unlock()
+	}()
+	fn()
+}
+
+// ExitSetFor returns the states whose Exit actions would run if event were sent now, from the
+// current state up to (not including) the common ancestor of the transition. It is empty when
+// the event would not fire a transition. Guards, Vetoes and the TargetPrecondition are evaluated,
+// but nothing is run.
+func (sm *HierarchicalStateMachine) ExitSetFor(event string) []*State {
+	// A preview is not a dispatch, so it must not show up in the guard trace
+	tracing := sm.tracingGuards
+	sm.tracingGuards = false
+	defer func() { sm.tracingGuards = tracing }()
+
+	event = sm.resolveEvent(event)
+	if !accepts(sm.CurrentState, event) {
+		return nil
+	}
+	transition, _, err := sm.selectTransition(trigger{event: event, named: true})
+	if transition == nil || err != nil || transition.SkipExit || !allPredicatesPass(transition.Vetoes) {
+		return nil
+	}
+	if transition.TargetPrecondition != nil && !transition.TargetPrecondition() {
+		return nil
+	}
+
+	commonAncestor := findCommonAncestor(transition.CurrentState, transition.NextState)
+	var exits []*State
+	for state := sm.CurrentState; state != commonAncestor; state = state.ParentState {
+		exits = append(exits, state)
+	}
+	return exits
+}
+
+// Returns the entry phases from (not including) the common ancestor down to the state
+func planEntry(state *State, commonAncestor *State) []string {
+	var plan []string
+	for ; state != commonAncestor; state = state.ParentState {
+		plan = append([]string{"enter " + string(state.Name)}, plan...)
+	}
+	return plan
+}
+
+// TransitionsByState groups the transitions by source state, in declaration order. Transitions
+// without a CurrentState are grouped under the nil key. The slices are built on each call, so
+// changing them doesn't affect the machine.
+func (sm *HierarchicalStateMachine) TransitionsByState() map[*State][]*Transition {
+	grouped := map[*State][]*Transition{}
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		grouped[transition.CurrentState] = append(grouped[transition.CurrentState], transition)
+	}
+	return grouped
+}
+
+// AllEvents returns the sorted, de-duplicated names of the events used by the transitions.
+// Unnamed events are left out.
+func (sm *HierarchicalStateMachine) AllEvents() []string {
+	seen := map[string]bool{}
+	var events []string
+	for i := range sm.transitions {
+		name := sm.transitions[i].EventName
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		events = append(events, name)
+	}
+	sort.Strings(events)
+	return events
+}
+
+// IncomingTransitions returns every transition whose NextState is s
+func (sm *HierarchicalStateMachine) IncomingTransitions(s *State) []*Transition {
+	var incoming []*Transition
+	for i := range sm.transitions {
+		if sm.transitions[i].NextState == s {
+			incoming = append(incoming, &sm.transitions[i])
+		}
+	}
+	return incoming
+}
+
+// IsDeadEnd reports whether the current state has no outgoing transitions, so the machine can
+// never leave it. Transitions on its ancestors only count if they can fire from it: those with
+// FromDescendants and, under PropagationBubbling, those on named events. OnEntry transitions
+// don't count, since they are only tried on entering their source.
+func (sm *HierarchicalStateMachine) IsDeadEnd() bool {
+	return !sm.hasOutgoing(sm.CurrentState)
+}
+
+func (sm *HierarchicalStateMachine) hasOutgoing(state *State) bool {
+	for i := range sm.transitions {
+		if sm.leavesAtRest(&sm.transitions[i], state) {
+			return true
+		}
+	}
+	return false
+}
+
+// EvaluationOrder returns the transitions from the state in the order a dispatch considers them,
+// the first eligible one firing. Under HighestPriority they are ordered by descending Priority,
+// ties broken by WithTieBreaker, and otherwise in declaration order. Transitions inherited from
+// ancestors follow, nearest ancestor first. Those with FromDescendants are reached by every
+// dispatch, the others only by events that bubble up: the WithAutoComplete event, and every named
+// event under PropagationBubbling. OnEntry transitions are left out, since they are only tried on
+// entering their source.
+func (sm *HierarchicalStateMachine) EvaluationOrder(state *State) []*Transition {
+	var order []*Transition
+	for source, depth := state, 0; source != nil && depth < MaxStates; source, depth = source.ParentState, depth+1 {
+		var fromSource []*Transition
+		for i := range sm.transitions {
+			if sm.transitions[i].CurrentState == source && !sm.transitions[i].OnEntry {
+				fromSource = append(fromSource, &sm.transitions[i])
+			}
+		}
+		if sm.duplicatePolicy == HighestPriority {
+			sort.SliceStable(fromSource, func(i, j int) bool { return sm.outranks(fromSource[i], fromSource[j]) })
+		}
+		order = append(order, fromSource...)
+	}
+	return order
+}
+
+// ReachableWithin returns every state the machine could settle in within n transitions from the
+// current state, ignoring guards, mapped to the fewest transitions needed. The current state is
+// at distance 0.
+func (sm *HierarchicalStateMachine) ReachableWithin(n int) map[*State]int {
+	distances := map[*State]int{sm.CurrentState: 0}
+	frontier := []*State{sm.CurrentState}
+	for distance := 1; distance <= n && len(frontier) > 0; distance++ {
+		var next []*State
+		for _, state := range frontier {
+			for i := range sm.transitions {
+				transition := &sm.transitions[i]
+				if !sm.canLeave(transition, state) || transition.NextState == nil {
+					continue
+				}
+				for _, settled := range possibleSettles(transition.NextState) {
+					if _, ok := distances[settled]; !ok {
+						distances[settled] = distance
+						next = append(next, settled)
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+	return distances
+}
+
+// ShadowedTransitions pairs each ancestor transition with a descendant transition on the same
+// event, which is matched first whenever an event bubbles up from the descendant, such as the
+// WithAutoComplete event. The ancestor transition comes first in each pair.
+func (sm *HierarchicalStateMachine) ShadowedTransitions() [][2]*Transition {
+	var shadowed [][2]*Transition
+	for i := range sm.transitions {
+		ancestor := &sm.transitions[i]
+		for j := range sm.transitions {
+			child := &sm.transitions[j]
+			if child.CurrentState != nil && isDescendant(child.CurrentState, ancestor.CurrentState) && sameTrigger(ancestor, child) {
+				shadowed = append(shadowed, [2]*Transition{ancestor, child})
+			}
+		}
+	}
+	return shadowed
+}
+
+// UnrelatedTransitions returns the transitions whose source and target share no common ancestor
+func (sm *HierarchicalStateMachine) UnrelatedTransitions() []*Transition {
+	var unrelated []*Transition
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if transition.CurrentState == nil || transition.NextState == nil {
+			continue
+		}
+		if findCommonAncestor(transition.CurrentState, transition.NextState) == nil {
+			unrelated = append(unrelated, transition)
+		}
+	}
+	return unrelated
+}
+
+// SameRegion reports whether a and b are inside the same composite: their deepest common
+// ancestor, which may be a or b itself, exists and either has children or has a parent, which
+// is then the composite they share. Unrelated states and a standalone state compared with itself
+// are not in the same region.
+func (sm *HierarchicalStateMachine) SameRegion(a, b *State) bool {
+	commonAncestor := findCommonAncestor(a, b)
+	if commonAncestor == nil {
+		return false
+	}
+	return commonAncestor.ParentState != nil || isParentOfAny(commonAncestor, sm.States())
+}
+
+// CompositeStates returns every state known to the machine that is the ParentState of another, in
+// the order of States()
+func (sm *HierarchicalStateMachine) CompositeStates() []*State {
+	states := sm.States()
+	var composites []*State
+	for _, state := range states {
+		if isParentOfAny(state, states) {
+			composites = append(composites, state)
+		}
+	}
+	return composites
+}
+
+// longestPathBudget bounds the path extensions LongestPath tries, since finding the longest
+// simple path in a cyclic graph is exponential
+const longestPathBudget = 1 << 16
+
+// LongestPath returns the longest chain of states the machine can settle in one after another
+// from its initial state, ignoring guards, including the initial settled state. No state repeats,
+// so cycles are cut where they return to a state already on the path. On an acyclic machine the
+// result is exact; on a heavily cyclic one the search gives up after a bounded number of steps and
+// returns the longest path found by then. Ties go to the path found first in declaration order.
+func (sm *HierarchicalStateMachine) LongestPath() []*State {
+	var longest, path []*State
+	onPath := map[*State]bool{}
+	budget := longestPathBudget
+
+	var extend func(state *State)
+	extend = func(state *State) {
+		path = append(path, state)
+		onPath[state] = true
+		if len(path) > len(longest) {
+			longest = append(longest[:0], path...)
+		}
+		for i := range sm.transitions {
+			transition := &sm.transitions[i]
+			if !sm.canLeave(transition, state) || transition.NextState == nil {
+				continue
+			}
+			for _, settled := range possibleSettles(transition.NextState) {
+				if onPath[settled] || budget == 0 {
+					continue
+				}
+				budget--
+				extend(settled)
+			}
+		}
+		onPath[state] = false
+		path = path[:len(path)-1]
+	}
+
+	if sm.initialState != nil {
+		for _, settled := range possibleSettles(sm.initialState) {
+			extend(settled)
+		}
+	}
+	return longest
+}
+
+// MaxActionsPerTransition returns the most actions a single transition can run: the Exit actions
+// up to the common ancestor, the transition's Actions, ActionsWithDepth and CheckedActions, then
+// the Entry and EntryWithReason actions down to the state the machine settles in, along with its
+// PathActions, and finally OnComplete. The OnRegionExit, OnRegionEnter and OnFirstEnter hooks and
+// the starting and stopping of each DoActivity along the way count as actions too.
+// Exits are counted from the deepest state the machine can be in below the source and entries
+// through the initial states or choices with the most actions, so the result is a worst case.
+func (sm *HierarchicalStateMachine) MaxActionsPerTransition() int {
+	most := 0
+	states := sm.knownStates(true)
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if transition.CurrentState == nil || transition.NextState == nil {
+			continue
+		}
+		commonAncestor := findCommonAncestor(transition.CurrentState, transition.NextState)
+		exits, entries := 0, 0
+		if !transition.SkipExit {
+			for _, state := range states {
+				if state == transition.CurrentState || isDescendant(state, transition.CurrentState) {
+					if count := sm.pathActionCount(transition, state, commonAncestor, false); count > exits {
+						exits = count
+					}
+				}
+			}
+		}
+		if !transition.SkipEntry {
+			for _, settled := range possibleSettles(transition.NextState) {
+				if count := sm.pathActionCount(transition, settled, commonAncestor, true); count > entries {
+					entries = count
+				}
+			}
+		}
+		count := exits + len(transition.Actions) + len(transition.ActionsWithDepth) + len(transition.CheckedActions) + entries
+		if transition.OnComplete != nil {
+			count++
+		}
+		if count > most {
+			most = count
+		}
+	}
+	return most
+}
+
+// Returns how many exit or entry actions the transition runs between the state and the common
+// ancestor, with the hooks and activities run alongside them
+func (sm *HierarchicalStateMachine) pathActionCount(transition *Transition, state, commonAncestor *State, entering bool) int {
+	count := 0
+	for depth := 0; state != commonAncestor && state != nil && depth < MaxStates; state, depth = state.ParentState, depth+1 {
+		count += len(transition.PathActions[state])
+		if state.DoActivity != nil {
+			count++
+		}
+		if entering {
+			count += len(state.Entry) + len(state.EntryWithReason) + len(sm.firstEnter[state.Name])
+			if _, ok := sm.regionEnters[state]; ok {
+				count++
+			}
+		} else {
+			count += len(state.Exit)
+			if _, ok := sm.regionExits[state]; ok {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// TransitionsEnabledBy returns the transitions leaving the current state, in declaration order,
+// whose guards are blocked now but would pass were the extended state variable key set to value,
+// such as what a top-up would make possible. Events are ignored and AsyncGuards not awaited.
+// The variable is set only while the guards are evaluated and then restored; nothing is fired.
+func (sm *HierarchicalStateMachine) TransitionsEnabledBy(key string, value interface{}) []*Transition {
+	before := sm.guardPassingTransitions()
+	previous, wasSet := sm.GetVar(key)
+	sm.SetVar(key, value)
+	after := sm.guardPassingTransitions()
+	if wasSet {
+		sm.vars[key] = previous
+	} else {
+		delete(sm.vars, key)
+	}
+
+	var enabled []*Transition
+	for i := range sm.transitions {
+		if transition := &sm.transitions[i]; after[transition] && !before[transition] {
+			enabled = append(enabled, transition)
+		}
+	}
+	return enabled
+}
+
+// Returns the transitions leaving the current state whose Guards, GuardGroups, VarGuards and
+// CheckedGuards pass, a guard error counting as a failure
+func (sm *HierarchicalStateMachine) guardPassingTransitions() map[*Transition]bool {
+	passing := map[*Transition]bool{}
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if !sm.leavesAtRest(transition, sm.CurrentState) || !guardsPassed(transition) || !sm.varGuardsPassed(transition) {
+			continue
+		}
+		if passed, err := checkedGuardsPassed(transition, nil); passed && err == nil {
+			passing[transition] = true
+		}
+	}
+	return passing
+}
+
+// GuardConflicts pairs transitions from the same state on the same trigger whose guards can be
+// true at once, found by comparing the extended state variables their VarGuards require, which
+// opaque closures would hide. Two transitions conflict unless their VarGuards require different
+// values of the same variable. Other guards can't be compared, so they are assumed to pass
+// together, and none is called. The transition declared first comes first in each pair.
+func (sm *HierarchicalStateMachine) GuardConflicts() [][2]*Transition {
+	var conflicts [][2]*Transition
+	for i := range sm.transitions {
+		for j := i + 1; j < len(sm.transitions); j++ {
+			a, b := &sm.transitions[i], &sm.transitions[j]
+			if a.CurrentState != b.CurrentState || a.OnEntry != b.OnEntry || !sameTrigger(a, b) {
+				continue
+			}
+			if satisfiable(append(append([]VarCondition(nil), a.VarGuards...), b.VarGuards...)) {
+				conflicts = append(conflicts, [2]*Transition{a, b})
+			}
+		}
+	}
+	return conflicts
+}
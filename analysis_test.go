@@ -0,0 +1,753 @@
+package hierarchicalStateMachine
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEmptyStates(t *testing.T) {
+	bare := State{}
+
+	sm, err := NewHierarchicalStateMachine(&bare, []State{bare}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the bare state is reported
+	expected := []*State{&bare}
+	if empty := sm.EmptyStates(); !reflect.DeepEqual(empty, expected) {
+		t.Errorf("Expected empty states %v, got %v", expected, empty)
+	}
+
+	// Check states with actions or transitions are not reported
+	parentState := State{}
+	state1 := State{Entry: []Action{func() {}}, ParentState: &parentState}
+	state2 := State{}
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			NextState:    &state2,
+		},
+	}
+
+	sm, err = NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if empty := sm.EmptyStates(); len(empty) != 0 {
+		t.Errorf("Expected no empty states, got %v", empty)
+	}
+
+	// Check a declared state that nothing references is reported too
+	unused := State{Name: "unused"}
+	sm, err = NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState, unused}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if empty := sm.EmptyStates(); len(empty) != 1 || empty[0].Name != "unused" {
+		t.Errorf("Expected the unused state to be empty, got %v", empty)
+	}
+}
+
+func TestStateDepth(t *testing.T) {
+	parentState2 := State{}
+	parentState := State{ParentState: &parentState2}
+	state1 := State{ParentState: &parentState}
+	state2 := State{ParentState: &parentState2}
+	state3 := State{}
+
+	expected := map[*State]int{
+		&parentState2: 0,
+		&parentState:  1,
+		&state1:       2,
+		&state2:       1,
+		&state3:       0,
+	}
+	for state, depth := range expected {
+		if state.Depth() != depth {
+			t.Errorf("Expected depth %d, got %d", depth, state.Depth())
+		}
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3, parentState, parentState2}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if sm.CurrentDepth() != 2 {
+		t.Errorf("Expected current depth 2, got %d", sm.CurrentDepth())
+	}
+
+	// Check a cyclic hierarchy is bounded
+	cycle1 := State{}
+	cycle2 := State{ParentState: &cycle1}
+	cycle1.ParentState = &cycle2
+	if cycle1.Depth() != MaxStates {
+		t.Errorf("Expected cyclic depth to be bounded at %d, got %d", MaxStates, cycle1.Depth())
+	}
+}
+
+func TestPlanTransition(t *testing.T) {
+	resetExecutedActions()
+
+	parentState2 := State{
+		Name:  "parent2",
+		Entry: []Action{recordAction("enter parent2")},
+		Exit:  []Action{recordAction("exit parent2")},
+	}
+	parentState := State{
+		Name:        "parent",
+		Entry:       []Action{recordAction("enter parent")},
+		Exit:        []Action{recordAction("exit parent")},
+		ParentState: &parentState2,
+	}
+	state1 := State{
+		Name:        "state1",
+		Entry:       []Action{recordAction("enter state1")},
+		Exit:        []Action{recordAction("exit state1")},
+		ParentState: &parentState,
+	}
+	state3 := State{
+		Name:  "state3",
+		Entry: []Action{recordAction("enter state3")},
+		Exit:  []Action{recordAction("exit state3")},
+	}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			Actions:      []Action{recordAction("actions")},
+			NextState:    &state3,
+		},
+		{
+			CurrentState: &state3,
+			Event:        func() bool { return true },
+			Actions:      []Action{recordAction("actions")},
+			NextState:    &state1,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state3, parentState, parentState2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	for i := range transitions {
+		resetExecutedActions()
+		plan := sm.PlanTransition(&sm.transitions[i])
+
+		// Check planning runs nothing
+		if len(executedActions) != 0 {
+			t.Errorf("Expected planning to run no actions, got %v", executedActions)
+		}
+
+		HandleStateMachine(sm)
+
+		// Check the plan matches the executed order
+		if !reflect.DeepEqual(plan, executedActions) {
+			t.Errorf("Expected plan %v to match executed actions %v", plan, executedActions)
+		}
+	}
+}
+
+func TestAllEvents(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "start", NextState: &state2},
+		{CurrentState: &state2, EventName: "cancel", NextState: &state1},
+		{CurrentState: &state3, EventName: "start", NextState: &state2},
+		{CurrentState: &state3, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	expected := []string{"cancel", "start"}
+	if events := sm.AllEvents(); !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestIncomingTransitions(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state3},
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state3},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	expected := []*Transition{&sm.transitions[0], &sm.transitions[2]}
+	if incoming := sm.IncomingTransitions(&state3); !reflect.DeepEqual(incoming, expected) {
+		t.Errorf("Expected incoming transitions %v, got %v", expected, incoming)
+	}
+	if incoming := sm.IncomingTransitions(&state1); len(incoming) != 0 {
+		t.Errorf("Expected no incoming transitions, got %v", incoming)
+	}
+}
+
+func TestIsDeadEnd(t *testing.T) {
+	parentState := State{}
+	state1 := State{}
+	state2 := State{ParentState: &parentState}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &parentState, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	if sm.IsDeadEnd() {
+		t.Errorf("Expected state 1 not to be a dead end")
+	}
+
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	if !sm.IsDeadEnd() {
+		t.Errorf("Expected state 2 to be a dead end")
+	}
+}
+
+func TestStrictAncestry(t *testing.T) {
+	parentState := State{}
+	state1 := State{ParentState: &parentState}
+	state2 := State{ParentState: &parentState}
+	state3 := State{}
+	states := []State{state1, state2, state3, parentState}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state3},
+	}
+
+	// Check the default permits the cross-tree transition and flags it
+	sm, err := NewHierarchicalStateMachine(&state1, states, transitions)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []*Transition{&sm.transitions[1]}
+	if unrelated := sm.UnrelatedTransitions(); !reflect.DeepEqual(unrelated, expected) {
+		t.Errorf("Expected unrelated transitions %v, got %v", expected, unrelated)
+	}
+
+	// Check the strict check rejects it
+	_, err = NewHierarchicalStateMachine(&state1, states, transitions, WithStrictAncestry())
+	if err == nil {
+		t.Fatalf("Expected an error due to a cross-tree transition, got none")
+	}
+
+	// Check an explicit opt-in is accepted
+	transitions[1].CrossTree = true
+	if _, err = NewHierarchicalStateMachine(&state1, states, transitions, WithStrictAncestry()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestExitSetFor(t *testing.T) {
+	root := State{Name: "root"}
+	regionA := State{Name: "regionA", ParentState: &root}
+	leafA := State{Name: "leafA", ParentState: &regionA}
+	regionB := State{Name: "regionB", ParentState: &root}
+	leafB := State{Name: "leafB", ParentState: &regionB}
+	root.Initial = &regionA
+	regionA.Initial = &leafA
+
+	transitions := []Transition{
+		{CurrentState: &leafA, EventName: "switch", NextState: &leafB},
+		{CurrentState: &leafA, EventName: "blocked", Guards: []Predicate{func() bool { return false }}, NextState: &leafB},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&root, []State{root, regionA, leafA, regionB, leafB}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the cross-region event exits the leaf and its region but not the shared root
+	expected := []*State{&leafA, &regionA}
+	if exits := sm.ExitSetFor("switch"); !reflect.DeepEqual(exits, expected) {
+		t.Errorf("Expected exit set %v, got %v", expected, exits)
+	}
+	if sm.CurrentState != &leafA {
+		t.Errorf("Expected current state to be %v, got %v", &leafA, sm.CurrentState)
+	}
+
+	// Check events that wouldn't transition give an empty set
+	for _, event := range []string{"blocked", "unknown"} {
+		if exits := sm.ExitSetFor(event); len(exits) != 0 {
+			t.Errorf("Expected empty exit set for %q, got %v", event, exits)
+		}
+	}
+}
+
+func TestShadowedTransitions(t *testing.T) {
+	parent := State{Name: "parent"}
+	child := State{Name: "child", ParentState: &parent}
+	parent.Initial = &child
+	other := State{Name: "other"}
+
+	transitions := []Transition{
+		{CurrentState: &parent, EventName: "done", NextState: &other},
+		{CurrentState: &child, EventName: "done", NextState: &other},
+		{CurrentState: &child, EventName: "cancel", NextState: &other},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&parent, []State{parent, child, other}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check only the child transition on the parent's event shadows it
+	expected := [][2]*Transition{{&sm.transitions[0], &sm.transitions[1]}}
+	if shadowed := sm.ShadowedTransitions(); !reflect.DeepEqual(shadowed, expected) {
+		t.Errorf("Expected shadowed transitions %v, got %v", expected, shadowed)
+	}
+}
+
+func TestEvaluationOrder(t *testing.T) {
+	parent := State{Name: "parent"}
+	child := State{Name: "child", ParentState: &parent}
+	parent.Initial = &child
+	other := State{Name: "other"}
+
+	transitions := []Transition{
+		{CurrentState: &parent, EventName: "done", NextState: &other},
+		{CurrentState: &child, EventName: "a", Priority: 1, NextState: &other},
+		{CurrentState: &child, EventName: "b", Priority: 5, NextState: &other},
+		{CurrentState: &child, EventName: "c", Priority: 1, NextState: &other},
+		{CurrentState: &other, EventName: "back", NextState: &parent},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&parent, []State{parent, child, other}, transitions, WithDuplicatePolicy(HighestPriority))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check priorities order the child's own transitions, ties kept in declaration order, then the
+	// parent's inherited ones follow
+	expected := []*Transition{&sm.transitions[2], &sm.transitions[1], &sm.transitions[3], &sm.transitions[0]}
+	if order := sm.EvaluationOrder(&child); !reflect.DeepEqual(order, expected) {
+		t.Errorf("Expected evaluation order %v, got %v", eventNames(expected), eventNames(order))
+	}
+}
+
+// Returns the event names of the transitions, for readable failure messages
+func eventNames(transitions []*Transition) []string {
+	var names []string
+	for _, transition := range transitions {
+		names = append(names, transition.EventName)
+	}
+	return names
+}
+
+func TestReachableWithin(t *testing.T) {
+	state1 := State{Name: "state1"}
+	state2 := State{Name: "state2"}
+	state3 := State{Name: "state3"}
+	state4 := State{Name: "state4"}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state3},
+		{CurrentState: &state3, NextState: &state4},
+		{CurrentState: &state2, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3, state4}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the minimum distances along the chain, excluding state4 beyond the bound
+	expected := map[*State]int{&state1: 0, &state2: 1, &state3: 2}
+	if reachable := sm.ReachableWithin(2); !reflect.DeepEqual(reachable, expected) {
+		t.Errorf("Expected reachable states %v, got %v", expected, reachable)
+	}
+	if reachable := sm.ReachableWithin(10); reachable[&state4] != 3 {
+		t.Errorf("Expected state4 at distance 3, got %v", reachable)
+	}
+}
+
+func TestWithCurrentState(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Name: "state1", Exit: []Action{recordAction("State 1 Exit")}}
+	state2 := State{Name: "state2", Entry: []Action{recordAction("State 2 Entry")}}
+	state3 := State{Name: "state3"}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, EventName: "finish", NextState: &state3},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check queries inside fn see the overridden state
+	var exits []*State
+	sm.WithCurrentState(&state2, func() {
+		exits = sm.ExitSetFor("finish")
+	})
+	if !reflect.DeepEqual(exits, []*State{&state2}) {
+		t.Errorf("Expected exit set %v, got %v", []*State{&state2}, exits)
+	}
+
+	// Check the original state is restored without running any actions
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be restored to %v, got %v", &state1, sm.CurrentState)
+	}
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions, got %v", executedActions)
+	}
+}
+
+func TestTransitionsByState(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "a", NextState: &state2},
+		{CurrentState: &state2, EventName: "b", NextState: &state3},
+		{CurrentState: &state1, EventName: "c", NextState: &state3},
+		{EventName: "d", NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check each source's transitions in declaration order, sourceless ones under nil
+	expected := map[*State][]*Transition{
+		&state1: {&sm.transitions[0], &sm.transitions[2]},
+		&state2: {&sm.transitions[1]},
+		nil:     {&sm.transitions[3]},
+	}
+	grouped := sm.TransitionsByState()
+	if !reflect.DeepEqual(grouped, expected) {
+		t.Errorf("Expected grouped transitions %v, got %v", expected, grouped)
+	}
+
+	// Check the slices are copies
+	grouped[&state1][0] = nil
+	if sm.TransitionsByState()[&state1][0] != &sm.transitions[0] {
+		t.Errorf("Expected changes to the returned slices not to affect the machine")
+	}
+}
+
+func TestSameRegion(t *testing.T) {
+	parent := State{Name: "parent"}
+	child1 := State{Name: "child1", ParentState: &parent}
+	child2 := State{Name: "child2", ParentState: &parent}
+	standalone := State{Name: "standalone"}
+	parent.Initial = &child1
+
+	transitions := []Transition{
+		{CurrentState: &child1, NextState: &child2},
+		{CurrentState: &child2, NextState: &standalone},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&parent, []State{parent, child1, child2, standalone}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check siblings and a child with its parent share the region
+	if !sm.SameRegion(&child1, &child2) {
+		t.Errorf("Expected %q and %q to be in the same region", child1.Name, child2.Name)
+	}
+	if !sm.SameRegion(&child1, &parent) {
+		t.Errorf("Expected %q and %q to be in the same region", child1.Name, parent.Name)
+	}
+	if !sm.SameRegion(&child1, &child1) {
+		t.Errorf("Expected %q to be in a region with itself", child1.Name)
+	}
+
+	// Check a standalone state shares no region
+	if sm.SameRegion(&child1, &standalone) {
+		t.Errorf("Expected %q and %q not to be in the same region", child1.Name, standalone.Name)
+	}
+	if sm.SameRegion(&standalone, &standalone) {
+		t.Errorf("Expected %q not to be in a region with itself", standalone.Name)
+	}
+}
+
+func TestCompositeStates(t *testing.T) {
+	parent2 := State{Name: "parent2"}
+	parent := State{Name: "parent", ParentState: &parent2}
+	state1 := State{Name: "state1", ParentState: &parent}
+	state2 := State{Name: "state2", ParentState: &parent2}
+	state3 := State{Name: "state3"}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state3},
+		{CurrentState: &state3, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{parent2, parent, state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check both parents are returned and the leaves are not
+	expected := []*State{&parent, &parent2}
+	if composites := sm.CompositeStates(); !reflect.DeepEqual(composites, expected) {
+		t.Errorf("Expected composite states %v, got %v", expected, composites)
+	}
+}
+
+func TestLongestPath(t *testing.T) {
+	start := State{Name: "start"}
+	review := State{Name: "review"}
+	approve := State{Name: "approve"}
+	publish := State{Name: "publish"}
+	archive := State{Name: "archive"}
+
+	transitions := []Transition{
+		{CurrentState: &start, EventName: "skip", NextState: &publish},
+		{CurrentState: &start, EventName: "submit", NextState: &review},
+		{CurrentState: &review, EventName: "approve", NextState: &approve},
+		{CurrentState: &review, EventName: "reject", NextState: &start},
+		{CurrentState: &approve, EventName: "publish", NextState: &publish},
+		{CurrentState: &publish, EventName: "archive", NextState: &archive},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&start, []State{start, review, approve, publish, archive}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the longest chain is found and the cycle back to start is cut
+	expected := []*State{&start, &review, &approve, &publish, &archive}
+	if path := sm.LongestPath(); !reflect.DeepEqual(path, expected) {
+		t.Errorf("Expected path %v, got %v", expected, path)
+	}
+}
+
+func TestMaxActionsPerTransition(t *testing.T) {
+	action := func() {}
+	parentState2 := State{Entry: []Action{action}, Exit: []Action{action}}
+	parentState := State{Entry: []Action{action}, Exit: []Action{action}, ParentState: &parentState2}
+	state1 := State{Entry: []Action{action}, Exit: []Action{action}, ParentState: &parentState}
+	state2 := State{Entry: []Action{action}, Exit: []Action{action}, ParentState: &parentState2}
+	state3 := State{Entry: []Action{action}, Exit: []Action{action}}
+
+	transitions := []Transition{
+		{CurrentState: &state1, Actions: []Action{action}, NextState: &state2},
+		{CurrentState: &state2, Actions: []Action{action}, NextState: &state3},
+		{CurrentState: &state3, Actions: []Action{action}, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3, parentState, parentState2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the worst case is state 3 to state 1: one exit, one action and three entries
+	if count := sm.MaxActionsPerTransition(); count != 5 {
+		t.Errorf("Expected 5 actions, got %d", count)
+	}
+
+	// Check region hooks on the way are counted
+	sm.OnRegionEnter(&parentState, action)
+	if count := sm.MaxActionsPerTransition(); count != 6 {
+		t.Errorf("Expected 6 actions, got %d", count)
+	}
+
+	// Check checked actions and OnComplete are counted
+	checked := func() error { return nil }
+	bare1, bare2 := State{}, State{}
+	sm, err = NewHierarchicalStateMachine(&bare1, []State{bare1, bare2}, []Transition{
+		{CurrentState: &bare1, CheckedActions: []func() error{checked, checked}, OnComplete: action, NextState: &bare2},
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if count := sm.MaxActionsPerTransition(); count != 3 {
+		t.Errorf("Expected 3 actions, got %d", count)
+	}
+}
+
+func TestTransitionsEnabledBy(t *testing.T) {
+	cart := State{Name: "cart"}
+	paid := State{Name: "paid"}
+	saved := State{Name: "saved"}
+
+	var sm *HierarchicalStateMachine
+	balance := func(want int) Predicate {
+		return func() bool { return VarEquals(sm, "balance", want)() }
+	}
+	transitions := []Transition{
+		{CurrentState: &cart, EventName: "save", NextState: &saved},
+		{CurrentState: &cart, EventName: "pay", Guards: []Predicate{balance(10)}, NextState: &paid},
+		{CurrentState: &cart, EventName: "pay", Guards: []Predicate{balance(20)}, NextState: &paid},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&cart, []State{cart, paid, saved}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.SetVar("balance", 0)
+
+	// Check only the blocked transition the new value satisfies is reported
+	enabled := sm.TransitionsEnabledBy("balance", 10)
+	if len(enabled) != 1 || enabled[0] != &sm.transitions[1] {
+		t.Errorf("Expected only %v, got %v", &sm.transitions[1], enabled)
+	}
+
+	// Check the variable is restored and the machine didn't move
+	if v, _ := sm.GetVar("balance"); v != 0 || sm.CurrentState != &cart {
+		t.Errorf("Expected balance 0 in %v, got %v in %v", &cart, v, sm.CurrentState)
+	}
+
+	// Check an unset variable is unset again
+	sm.TransitionsEnabledBy("discount", 5)
+	if _, ok := sm.GetVar("discount"); ok {
+		t.Errorf("Expected discount to be unset")
+	}
+}
+
+func TestGuardConflicts(t *testing.T) {
+	newMachine := func(first, second []VarCondition, guards ...Predicate) *HierarchicalStateMachine {
+		cart := State{Name: "cart"}
+		paid := State{Name: "paid"}
+		refused := State{Name: "refused"}
+
+		transitions := []Transition{
+			{CurrentState: &cart, EventName: "pay", VarGuards: first, Guards: guards, NextState: &paid},
+			{CurrentState: &cart, EventName: "pay", VarGuards: second, NextState: &refused},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&cart, []State{cart, paid, refused}, transitions)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm
+	}
+
+	// Check guards that can hold together are reported
+	sm := newMachine(
+		[]VarCondition{{Key: "tier", Value: "gold"}},
+		[]VarCondition{{Key: "tier", Value: "gold"}, {Key: "blocked", Value: true}},
+	)
+	if conflicts := sm.GuardConflicts(); len(conflicts) != 1 || conflicts[0][0] != &sm.transitions[0] || conflicts[0][1] != &sm.transitions[1] {
+		t.Errorf("Expected one conflict between the pay transitions, got %v", conflicts)
+	}
+
+	// Check guards requiring different values of the same variable are not
+	sm = newMachine(
+		[]VarCondition{{Key: "tier", Value: "gold"}},
+		[]VarCondition{{Key: "tier", Value: "silver"}},
+	)
+	if conflicts := sm.GuardConflicts(); len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts, got %v", conflicts)
+	}
+
+	// Check a closure can't rule out a conflict and isn't called
+	calls := 0
+	sm = newMachine(nil, []VarCondition{{Key: "tier", Value: "silver"}}, func() bool {
+		calls++
+		return VarEquals(sm, "tier", "gold")() || VarEquals(sm, "tier", "silver")()
+	})
+	if conflicts := sm.GuardConflicts(); len(conflicts) != 1 {
+		t.Errorf("Expected one conflict between the pay transitions, got %v", conflicts)
+	}
+	if calls != 0 {
+		t.Errorf("Expected the predicate not to be called, got %d calls", calls)
+	}
+}
+
+func TestAnalysisEventPropagation(t *testing.T) {
+	app := State{Name: "app"}
+	editor := State{Name: "editor", ParentState: &app}
+	cursor := State{Name: "cursor", ParentState: &editor}
+	closed := State{Name: "closed"}
+	app.Initial = &editor
+	editor.Initial = &cursor
+
+	transitions := []Transition{{CurrentState: &app, EventName: "quit", NextState: &closed}}
+
+	sm, err := NewHierarchicalStateMachine(&app, []State{app, editor, cursor, closed}, transitions, WithEventPropagation(PropagationBubbling))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the grandparent's transition counts as leaving the leaf under bubbling
+	if sm.IsDeadEnd() {
+		t.Errorf("Expected %v not to be a dead end", &cursor)
+	}
+	if reachable := sm.ReachableWithin(1); len(reachable) != 2 {
+		t.Errorf("Expected 2 states within one transition, got %v", reachable)
+	}
+	for _, finding := range sm.Validate().ByCategory(CategoryDeadEnd) {
+		if containsState(finding.States, &cursor) {
+			t.Errorf("Expected no dead end finding for %v, got %v", &cursor, finding)
+		}
+	}
+}
+
+func TestAnalysisOnEntryAtRest(t *testing.T) {
+	newMachine := func(opts ...Option) (*HierarchicalStateMachine, map[StateName]*State) {
+		flow := State{Name: "flow"}
+		start := State{Name: "start", ParentState: &flow}
+		stuck := State{Name: "stuck", ParentState: &flow}
+		next := State{Name: "next", ParentState: &flow}
+		end := State{Name: "end"}
+		flow.Initial = &start
+
+		transitions := []Transition{
+			{CurrentState: &start, EventName: "go", NextState: &stuck},
+			{CurrentState: &stuck, OnEntry: true, Guards: []Predicate{func() bool { return false }}, NextState: &next},
+			{CurrentState: &flow, EventName: "done", NextState: &end},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&flow, []State{flow, start, stuck, next, end}, transitions, opts...)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm, map[StateName]*State{"stuck": &stuck, "end": &end}
+	}
+
+	// Check a state whose only exit is an OnEntry transition is a dead end once settled
+	sm, states := newMachine()
+	sm.SendEvent("go")
+	if !sm.IsDeadEnd() {
+		t.Errorf("Expected %v to be a dead end", sm.CurrentState)
+	}
+	if order := sm.EvaluationOrder(states["stuck"]); len(order) != 1 || order[0].EventName != "done" {
+		t.Errorf("Expected only the done transition to be evaluated, got %v", order)
+	}
+
+	// Check FuzzDrive stops instead of polling the stuck machine
+	sm, _ = newMachine()
+	if visited := sm.FuzzDrive(rand.New(rand.NewSource(1)), 5); !reflect.DeepEqual(visited, []StateName{"start", "stuck"}) {
+		t.Errorf("Expected FuzzDrive to stop in stuck, got %v", visited)
+	}
+
+	// Check the auto-complete event is posted once the OnEntry transition doesn't fire
+	sm, states = newMachine(WithAutoComplete("done"))
+	sm.SendEvent("go")
+	if sm.CurrentState != states["end"] {
+		t.Errorf("Expected current state to be %v, got %v", states["end"], sm.CurrentState)
+	}
+}
@@ -0,0 +1,138 @@
+package hierarchicalStateMachine
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// checkpoint is the serialized form of a machine's runtime state. States and transitions are
+// identified by their index in the definition, so it can only be resumed by a machine built from
+// the same states and transitions.
+type checkpoint struct {
+	States           int           `json:"states"`
+	Transitions      int           `json:"transitions"`
+	CurrentState     int           `json:"current_state"`
+	TransitionCounts []int         `json:"transition_counts"`
+	DispatchStats    DispatchStats `json:"dispatch_stats"`
+	Visited          []int         `json:"visited"`
+}
+
+// Checkpoint captures the current state, the transition counts, the dispatch stats and which
+// states have been entered, for moving a running workflow to another machine with
+// ResumeFromCheckpoint. The machine must be quiescent: it fails while a dispatch is in progress or
+// while WithDeferredExecution still holds actions that were not flushed or discarded. While Run
+// drives the machine, it waits for the dispatch in progress to finish and pauses the loop until
+// the checkpoint is taken; events not yet received from Run's channel are not captured. It must
+// not be called from an action.
+func (sm *HierarchicalStateMachine) Checkpoint() (data []byte, err error) {
+	sm.quiesced(func() { data, err = sm.checkpoint() })
+	return data, err
+}
+
+func (sm *HierarchicalStateMachine) checkpoint() ([]byte, error) {
+	if sm.handling {
+		return nil, fmt.Errorf("cannot checkpoint while a dispatch is in progress")
+	}
+	if len(sm.pendingActions) > 0 {
+		return nil, fmt.Errorf("cannot checkpoint with %d deferred actions pending", len(sm.pendingActions))
+	}
+
+	states := sm.knownStates(false)
+	index := func(state *State) int {
+		for i, known := range states {
+			if known == state {
+				return i
+			}
+		}
+		return -1
+	}
+
+	sm.mu.Lock()
+	cp := checkpoint{
+		States:           len(states),
+		Transitions:      len(sm.transitions),
+		CurrentState:     index(sm.CurrentState),
+		TransitionCounts: make([]int, len(sm.transitions)),
+		DispatchStats:    sm.dispatchStats,
+	}
+	for i := range sm.transitions {
+		cp.TransitionCounts[i] = sm.transitionCounts[&sm.transitions[i]]
+	}
+	sm.mu.Unlock()
+
+	if cp.CurrentState < 0 {
+		return nil, fmt.Errorf("current state %q is not registered with the machine", sm.CurrentState.Name)
+	}
+	for i, state := range states {
+		if sm.visited[state] {
+			cp.Visited = append(cp.Visited, i)
+		}
+	}
+	return json.Marshal(cp)
+}
+
+// ResumeFromCheckpoint restores what Checkpoint captured onto a machine built from the same
+// definition, typically a fresh one. The machine moves to the checkpointed state without running
+// any Exit or Entry actions, but the DoActivity of every state it is now in is restarted. While Run
+// drives the machine, the loop is paused between two events as for Checkpoint.
+func (sm *HierarchicalStateMachine) ResumeFromCheckpoint(data []byte) (err error) {
+	sm.quiesced(func() { err = sm.resumeFromCheckpoint(data) })
+	return err
+}
+
+func (sm *HierarchicalStateMachine) resumeFromCheckpoint(data []byte) error {
+	if sm.handling {
+		return fmt.Errorf("cannot resume while a dispatch is in progress")
+	}
+	if sm.IsLocked() {
+		return ErrMachineLocked
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return fmt.Errorf("invalid checkpoint: %w", err)
+	}
+
+	states := sm.knownStates(false)
+	if cp.States != len(states) || cp.Transitions != len(sm.transitions) || len(cp.TransitionCounts) != len(sm.transitions) {
+		return fmt.Errorf("checkpoint of a machine with %d states and %d transitions cannot resume one with %d and %d", cp.States, cp.Transitions, len(states), len(sm.transitions))
+	}
+	if cp.CurrentState < 0 || cp.CurrentState >= len(states) {
+		return fmt.Errorf("checkpoint current state %d is out of range", cp.CurrentState)
+	}
+	for _, i := range cp.Visited {
+		if i < 0 || i >= len(states) {
+			return fmt.Errorf("checkpoint visited state %d is out of range", i)
+		}
+	}
+
+	for state := range sm.activities {
+		sm.stopActivity(state)
+	}
+	sm.clearPending()
+	sm.unentered = false
+
+	sm.mu.Lock()
+	sm.CurrentState = states[cp.CurrentState]
+	sm.enteredAt = sm.clock.Now()
+	for i := range sm.transitions {
+		sm.transitionCounts[&sm.transitions[i]] = cp.TransitionCounts[i]
+	}
+	sm.dispatchStats = cp.DispatchStats
+	sm.mu.Unlock()
+
+	sm.visited = map[*State]bool{}
+	for _, i := range cp.Visited {
+		sm.visited[states[i]] = true
+	}
+
+	var path []*State
+	for state, depth := sm.CurrentState, 0; state != nil && depth < MaxStates; state, depth = state.ParentState, depth+1 {
+		path = append(path, state)
+	}
+	sm.routingPanics(func() {
+		for i := len(path) - 1; i >= 0; i-- {
+			sm.startActivity(path[i])
+		}
+	})
+	return nil
+}
@@ -0,0 +1,155 @@
+package hierarchicalStateMachine
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// Returns a fresh order workflow machine and its states by name
+func newOrderMachine(t *testing.T) (*HierarchicalStateMachine, map[StateName]*State) {
+	order := &State{Name: "order"}
+	placed := &State{Name: "placed", ParentState: order}
+	paid := &State{Name: "paid", ParentState: order}
+	order.Initial = placed
+	shipped := &State{Name: "shipped", Entry: []Action{recordAction("Shipped Entry")}}
+
+	transitions := []Transition{
+		{CurrentState: placed, EventName: "pay", NextState: paid},
+		{CurrentState: paid, EventName: "refund", NextState: placed},
+		{CurrentState: paid, EventName: "ship", NextState: shipped},
+	}
+
+	sm, err := NewHierarchicalStateMachine(order, []State{*order, *placed, *paid, *shipped}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	return sm, map[StateName]*State{"order": order, "placed": placed, "paid": paid, "shipped": shipped}
+}
+
+// Returns the transition counts in declaration order, so machines can be compared
+func countsInOrder(sm *HierarchicalStateMachine) []int {
+	counts := sm.TransitionCounts()
+	ordered := make([]int, len(sm.transitions))
+	for i := range sm.transitions {
+		ordered[i] = counts[&sm.transitions[i]]
+	}
+	return ordered
+}
+
+func TestCheckpoint(t *testing.T) {
+	original, _ := newOrderMachine(t)
+	original.SendEvent("pay")
+	original.SendEvent("refund")
+	original.SendEvent("pay")
+
+	data, err := original.Checkpoint()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	resumed, states := newOrderMachine(t)
+	if err := resumed.ResumeFromCheckpoint(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Check the resumed machine is where the original was
+	if resumed.CurrentState != states["paid"] {
+		t.Errorf("Expected current state to be %v, got %v", states["paid"], resumed.CurrentState)
+	}
+	if !reflect.DeepEqual(countsInOrder(resumed), countsInOrder(original)) {
+		t.Errorf("Expected counts %v, got %v", countsInOrder(original), countsInOrder(resumed))
+	}
+	if resumed.DispatchStats() != original.DispatchStats() {
+		t.Errorf("Expected stats %+v, got %+v", original.DispatchStats(), resumed.DispatchStats())
+	}
+
+	// Check both machines continue identically
+	for _, sm := range []*HierarchicalStateMachine{original, resumed} {
+		resetExecutedActions()
+		sm.SendEvent("ship")
+		expectedActions := []string{"Shipped Entry"}
+		if !reflect.DeepEqual(executedActions, expectedActions) {
+			t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+		}
+		if sm.CurrentState.Name != "shipped" {
+			t.Errorf("Expected current state to be %q, got %q", "shipped", sm.CurrentState.Name)
+		}
+	}
+	if !reflect.DeepEqual(countsInOrder(resumed), countsInOrder(original)) {
+		t.Errorf("Expected counts %v, got %v", countsInOrder(original), countsInOrder(resumed))
+	}
+}
+
+func TestCheckpointMismatch(t *testing.T) {
+	original, _ := newOrderMachine(t)
+	data, err := original.Checkpoint()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	state1 := State{}
+	state2 := State{}
+	other, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, []Transition{{CurrentState: &state1, NextState: &state2}})
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check a checkpoint of another definition is refused
+	if err := other.ResumeFromCheckpoint(data); err == nil {
+		t.Errorf("Expected an error resuming a different machine, got nil")
+	}
+	if other.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, other.CurrentState)
+	}
+}
+
+func TestCheckpointRun(t *testing.T) {
+	// Returns the events channel of a Run loop driving sm, and a function stopping the loop
+	run := func(sm *HierarchicalStateMachine) (chan<- string, func()) {
+		events := make(chan string)
+		stopped := make(chan error)
+		go func() { stopped <- sm.Run(context.Background(), events) }()
+		return events, func() {
+			close(events)
+			if err := <-stopped; err != nil {
+				t.Errorf("Expected Run to return nil, got %v", err)
+			}
+		}
+	}
+
+	original, _ := newOrderMachine(t)
+	events, stop := run(original)
+	events <- "pay"
+	events <- "refund"
+	events <- "pay"
+
+	// Check the checkpoint waits for the last received event to be dispatched
+	data, err := original.Checkpoint()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resetExecutedActions()
+	events <- "ship"
+	stop()
+	expectedActions := append([]string(nil), executedActions...)
+
+	// Check a resumed machine continues identically under Run
+	resumed, states := newOrderMachine(t)
+	events, stop = run(resumed)
+	if err := resumed.ResumeFromCheckpoint(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resetExecutedActions()
+	events <- "ship"
+	stop()
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+	if resumed.CurrentState != states["shipped"] {
+		t.Errorf("Expected current state to be %v, got %v", states["shipped"], resumed.CurrentState)
+	}
+	if !reflect.DeepEqual(countsInOrder(resumed), countsInOrder(original)) {
+		t.Errorf("Expected counts %v, got %v", countsInOrder(original), countsInOrder(resumed))
+	}
+}
@@ -0,0 +1,144 @@
+package hierarchicalStateMachine
+
+import "sort"
+
+// CompiledMachine is an integer-indexed form of a machine's topology for embedded targets, where
+// stepping it follows no pointers and allocates nothing. States and events are identified by
+// their IDs, see StateID and EventID.
+type CompiledMachine struct {
+	stateNames []StateName
+	events     []string // Sorted, so an event's ID is its index
+	parents    []int    // Parent ID of each state, -1 for roots
+	table      []int    // Settled state ID for each state and event, -1 when no transition fires
+	current    int
+}
+
+// Compile builds the integer form of the machine, starting in its current state. Only the
+// topology is kept: guards are treated as passing, no actions run, polled transitions and
+// initial choices are left out and composites settle through their Initial state. Transitions are
+// selected as SendEvent selects them, including FromDescendants, PropagationBubbling and
+// HighestPriority.
+func (sm *HierarchicalStateMachine) Compile() *CompiledMachine {
+	states := sm.States()
+	ids := make(map[*State]int, len(states))
+	for i, state := range states {
+		ids[state] = i
+	}
+
+	cm := &CompiledMachine{
+		stateNames: make([]StateName, len(states)),
+		events:     sm.AllEvents(),
+		parents:    make([]int, len(states)),
+		current:    ids[sm.CurrentState],
+	}
+	for i, state := range states {
+		cm.stateNames[i] = state.Name
+		cm.parents[i] = -1
+		if state.ParentState != nil {
+			cm.parents[i] = ids[state.ParentState]
+		}
+	}
+
+	cm.table = make([]int, len(states)*len(cm.events))
+	for i, state := range states {
+		for j, event := range cm.events {
+			cm.table[i*len(cm.events)+j] = -1
+			if transition := sm.compiledTransition(state, event); transition != nil {
+				cm.table[i*len(cm.events)+j] = ids[settleThroughInitial(transition.NextState)]
+			}
+		}
+	}
+	return cm
+}
+
+// Returns the transition a named event fires from the state with every guard passing
+func (sm *HierarchicalStateMachine) compiledTransition(state *State, event string) *Transition {
+	if !accepts(state, event) {
+		return nil
+	}
+	for source, depth := state, 0; source != nil && depth < MaxStates; source, depth = source.ParentState, depth+1 {
+		var selected *Transition
+		for i := range sm.transitions {
+			transition := &sm.transitions[i]
+			if transition.CurrentState != source || transition.EventName != event || transition.OnEntry {
+				continue
+			}
+			if source != state && !transition.FromDescendants && sm.propagation != PropagationBubbling {
+				continue
+			}
+			if sm.duplicatePolicy != HighestPriority {
+				return transition
+			}
+			if selected == nil || sm.outranks(transition, selected) {
+				selected = transition
+			}
+		}
+		if selected != nil {
+			return selected
+		}
+	}
+	return nil
+}
+
+func settleThroughInitial(state *State) *State {
+	for depth := 0; state.Initial != nil && depth < MaxStates; depth++ {
+		state = state.Initial
+	}
+	return state
+}
+
+// Step sends the event and returns the ID of the state the machine is in afterwards. Unknown
+// event IDs leave it unchanged.
+func (cm *CompiledMachine) Step(eventID int) int {
+	if eventID < 0 || eventID >= len(cm.events) {
+		return cm.current
+	}
+	if next := cm.table[cm.current*len(cm.events)+eventID]; next >= 0 {
+		cm.current = next
+	}
+	return cm.current
+}
+
+// Current returns the ID of the current state
+func (cm *CompiledMachine) Current() int {
+	return cm.current
+}
+
+// EventID returns the ID of the named event, or -1 if no transition uses it
+func (cm *CompiledMachine) EventID(event string) int {
+	i := sort.SearchStrings(cm.events, event)
+	if i < len(cm.events) && cm.events[i] == event {
+		return i
+	}
+	return -1
+}
+
+// StateID returns the ID of the first state with the name, or -1 if there is none
+func (cm *CompiledMachine) StateID(name StateName) int {
+	for i, stateName := range cm.stateNames {
+		if stateName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// StateName returns the name of the state with the ID
+func (cm *CompiledMachine) StateName(id int) StateName {
+	return cm.stateNames[id]
+}
+
+// Parent returns the ID of the state's parent, or -1 for a root state
+func (cm *CompiledMachine) Parent(id int) int {
+	return cm.parents[id]
+}
+
+// IsIn reports whether the current state is the state or one of its descendants
+func (cm *CompiledMachine) IsIn(id int) bool {
+	for state, depth := cm.current, 0; state >= 0 && depth < MaxStates; state, depth = cm.parents[state], depth+1 {
+		if state == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package hierarchicalStateMachine
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Returns a machine with a composite, FromDescendants and Priority in its topology
+func newPlayerMachine(t testing.TB) *HierarchicalStateMachine {
+	stopped := &State{Name: "stopped"}
+	active := &State{Name: "active"}
+	playing := &State{Name: "playing", ParentState: active}
+	paused := &State{Name: "paused", ParentState: active}
+	active.Initial = playing
+
+	transitions := []Transition{
+		{CurrentState: stopped, EventName: "play", NextState: active},
+		{CurrentState: playing, EventName: "pause", NextState: paused},
+		{CurrentState: paused, EventName: "play", NextState: playing},
+		{CurrentState: paused, EventName: "stop", NextState: playing, Priority: -1},
+		{CurrentState: active, EventName: "stop", NextState: stopped, FromDescendants: true},
+		{CurrentState: paused, EventName: "stop", NextState: stopped, Priority: 1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(stopped, []State{*stopped, *active, *playing, *paused}, transitions, WithDuplicatePolicy(HighestPriority))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	return sm
+}
+
+func TestCompile(t *testing.T) {
+	sm := newPlayerMachine(t)
+	cm := sm.Compile()
+	events := []string{"play", "pause", "stop", "unknown"}
+
+	// Check the compiled machine follows the pointer-based one over a random event stream
+	rng := rand.New(rand.NewSource(7))
+	for i := 0; i < 500; i++ {
+		event := events[rng.Intn(len(events))]
+		sm.SendEvent(event)
+		if got := cm.StateName(cm.Step(cm.EventID(event))); got != sm.CurrentState.Name {
+			t.Fatalf("Expected state %q after %q, got %q", sm.CurrentState.Name, event, got)
+		}
+	}
+
+	// Check the ancestor table
+	cm.Step(cm.EventID("stop"))
+	cm.Step(cm.EventID("play"))
+	if !cm.IsIn(cm.StateID("active")) {
+		t.Errorf("Expected to be in %q", "active")
+	}
+	if cm.Parent(cm.StateID("paused")) != cm.StateID("active") {
+		t.Errorf("Expected the parent of %q to be %q", "paused", "active")
+	}
+}
+
+func TestCompiledStepAllocations(t *testing.T) {
+	cm := newPlayerMachine(t).Compile()
+	play, pause := cm.EventID("play"), cm.EventID("pause")
+
+	// Check stepping doesn't allocate
+	allocs := testing.AllocsPerRun(100, func() {
+		cm.Step(play)
+		cm.Step(pause)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations, got %v", allocs)
+	}
+}
+
+func BenchmarkCompiledStep(b *testing.B) {
+	cm := newPlayerMachine(b).Compile()
+	play, pause := cm.EventID("play"), cm.EventID("pause")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cm.Step(play)
+		cm.Step(pause)
+	}
+}
+
+func BenchmarkSendEvent(b *testing.B) {
+	sm := newPlayerMachine(b)
+	sm.SendEvent("play")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sm.SendEvent("pause")
+		sm.SendEvent("play")
+	}
+}
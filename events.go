@@ -0,0 +1,104 @@
+package hierarchicalStateMachine
+
+import "fmt"
+
+// SendEvent dispatches a named event to the current state, firing the first eligible transition
+// whose EventName matches after resolving aliases. Event predicates, Handle actions and the
+// handle hooks are not run. Reports whether a transition fired.
+func (sm *HierarchicalStateMachine) SendEvent(event string) bool {
+	return sm.Dispatch(event).Fired
+}
+
+// DispatchResult describes what dispatching an event did
+type DispatchResult struct {
+	Fired      bool
+	Transition *Transition // The transition that fired, if any
+	From, To   *State      // The state before the dispatch and, if a transition fired, the state it settled in
+	Deferred   bool        // The event was sent from an action and queued under ReentrancyQueue
+	Err        error       // A failed Precondition, a guard error under GuardErrorAbort or a failed checked action
+}
+
+// Dispatch works like SendEvent but reports the full outcome
+func (sm *HierarchicalStateMachine) Dispatch(event string) DispatchResult {
+	return sm.dispatch(trigger{event: sm.resolveEvent(event), named: true})
+}
+
+// Replay rebuilds the machine from a log of named events. It resets the machine to its initial
+// state and transition counts, entering the initial hierarchy again, then dispatches each event as
+// SendEvent would. It stops at the first event that fires no transition.
+func (sm *HierarchicalStateMachine) Replay(events []string) error {
+	return sm.replay(events, false)
+}
+
+// DryReplay works like Replay but runs no Entry, Exit or transition actions, so the final state
+// is reconstructed without side effects. Guards and Vetoes are still evaluated.
+func (sm *HierarchicalStateMachine) DryReplay(events []string) error {
+	return sm.replay(events, true)
+}
+
+func (sm *HierarchicalStateMachine) replay(events []string, dry bool) error {
+	if sm.IsLocked() {
+		return ErrMachineLocked
+	}
+
+	// The abandoned states are not exited, but their activities must not keep running
+	for state := range sm.activities {
+		sm.stopActivity(state)
+	}
+
+	sm.dryReplay = dry
+	defer func() { sm.dryReplay = false }()
+
+	sm.mu.Lock()
+	for transition := range sm.transitionCounts {
+		sm.transitionCounts[transition] = 0
+	}
+	sm.dispatchStats = DispatchStats{}
+	sm.mu.Unlock()
+	sm.lastFired = nil
+
+	sm.unentered = false
+	// Set first so a routed panic leaves from the initial state, as in the constructor
+	sm.mu.Lock()
+	sm.CurrentState = sm.initialState
+	sm.mu.Unlock()
+	sm.routingPanics(func() {
+		initial := sm.enterFromCommonAncestor(sm.initialState, nil, EntryInitial)
+		sm.mu.Lock()
+		sm.CurrentState = initial
+		sm.enteredAt = sm.clock.Now()
+		sm.mu.Unlock()
+	})
+
+	for i, event := range events {
+		result := sm.Dispatch(event)
+		if result.Err != nil {
+			return fmt.Errorf("replaying event %d %q: %w", i, event, result.Err)
+		}
+		if !result.Fired {
+			return fmt.Errorf("replaying event %d %q: not handled in state %q", i, event, stateName(sm.CurrentState))
+		}
+	}
+	return nil
+}
+
+// AddEventAlias makes SendEvent(alias) dispatch canonical. Aliases resolve transitively.
+func (sm *HierarchicalStateMachine) AddEventAlias(alias, canonical string) {
+	if sm.eventAliases == nil {
+		sm.eventAliases = map[string]string{}
+	}
+	sm.eventAliases[alias] = canonical
+}
+
+// Follows aliases until a canonical name, stopping at the first repeat if the aliases form a cycle
+func (sm *HierarchicalStateMachine) resolveEvent(event string) string {
+	seen := map[string]bool{event: true}
+	for {
+		canonical, ok := sm.eventAliases[event]
+		if !ok || seen[canonical] {
+			return event
+		}
+		seen[canonical] = true
+		event = canonical
+	}
+}
@@ -0,0 +1,352 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSendEvent(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{
+		Exit:   []Action{recordAction("State 1 Exit")},
+		Handle: []Action{recordAction("State 1 Handle")},
+	}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			EventName:    "start",
+			Actions:      []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check a named transition is not polled
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+
+	// Check an unknown event does nothing
+	resetExecutedActions()
+	if sm.SendEvent("stop") {
+		t.Errorf("Expected event %q not to fire a transition", "stop")
+	}
+
+	// Check the named event fires without running Handle actions
+	if !sm.SendEvent("start") {
+		t.Errorf("Expected event %q to fire a transition", "start")
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+	expectedActions := []string{"State 1 Exit", "State 1 -> State 2 Transition", "State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestEventAlias(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "cancel", NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	sm.AddEventAlias("abort", "stop")
+	sm.AddEventAlias("stop", "cancel")
+
+	// Check a cycle between aliases doesn't hang
+	sm.AddEventAlias("ping", "pong")
+	sm.AddEventAlias("pong", "ping")
+	if sm.SendEvent("ping") {
+		t.Errorf("Expected event %q not to fire a transition", "ping")
+	}
+
+	// Check aliases resolve transitively
+	if !sm.SendEvent("abort") {
+		t.Errorf("Expected event %q to fire a transition", "abort")
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestAutoComplete(t *testing.T) {
+	resetExecutedActions()
+
+	job := State{Name: "job", Exit: []Action{recordAction("Job Exit")}}
+	working := State{Name: "working", ParentState: &job, Exit: []Action{recordAction("Working Exit")}}
+	done := State{
+		Name:        "done",
+		ParentState: &job,
+		Entry:       []Action{recordAction("Done Entry")},
+		Exit:        []Action{recordAction("Done Exit")},
+	}
+	job.Initial = &working
+	finished := State{Name: "finished", Entry: []Action{recordAction("Finished Entry")}}
+
+	transitions := []Transition{
+		{CurrentState: &working, NextState: &done},
+		{CurrentState: &job, EventName: "complete", NextState: &finished},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&job, []State{job, working, done, finished}, transitions, WithAutoComplete("complete"))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if sm.CurrentState != &working {
+		t.Fatalf("Expected current state to be %v, got %v", &working, sm.CurrentState)
+	}
+
+	// Check landing on done posts the completion event, which the parent's transition consumes
+	resetExecutedActions()
+	HandleStateMachine(sm)
+	if sm.CurrentState != &finished {
+		t.Errorf("Expected current state to be %v, got %v", &finished, sm.CurrentState)
+	}
+	expectedActions := []string{"Working Exit", "Done Entry", "Done Exit", "Job Exit", "Finished Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check a dead end with no handler for the event stays put
+	resetExecutedActions()
+	HandleStateMachine(sm)
+	if sm.CurrentState != &finished || len(executedActions) != 0 {
+		t.Errorf("Expected to stay in %v without actions, got %v and %v", &finished, sm.CurrentState, executedActions)
+	}
+}
+
+func TestAutoCompleteLoop(t *testing.T) {
+	start := State{Name: "start"}
+	parent := State{Name: "parent"}
+	idle := State{Name: "idle", ParentState: &parent}
+	parent.Initial = &idle
+
+	transitions := []Transition{
+		{CurrentState: &start, EventName: "go", NextState: &parent},
+		{CurrentState: &parent, EventName: "done", NextState: &parent},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&start, []State{start, parent, idle}, transitions, WithAutoComplete("done"))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check restarting the composite on its own completion stops with an error
+	if result := sm.Dispatch("go"); !result.Fired || result.Err == nil {
+		t.Errorf("Expected the chain to be cut with an error, got %+v", result)
+	}
+	if sm.CurrentState != &idle {
+		t.Errorf("Expected current state to be %v, got %v", &idle, sm.CurrentState)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	newMachine := func() *HierarchicalStateMachine {
+		idle := State{Name: "idle", Entry: []Action{recordAction("Idle Entry")}}
+		running := State{Name: "running", Entry: []Action{recordAction("Running Entry")}}
+		paused := State{Name: "paused", Entry: []Action{recordAction("Paused Entry")}}
+
+		transitions := []Transition{
+			{CurrentState: &idle, EventName: "start", NextState: &running},
+			{CurrentState: &running, EventName: "pause", NextState: &paused},
+			{CurrentState: &paused, EventName: "resume", NextState: &running},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&idle, []State{idle, running, paused}, transitions)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm
+	}
+
+	log := []string{"start", "pause", "resume", "pause"}
+	live := newMachine()
+	for _, event := range log {
+		live.SendEvent(event)
+	}
+
+	// Check replaying the log reaches the live state, running the actions again
+	replayed := newMachine()
+	replayed.SendEvent("start")
+	resetExecutedActions()
+	if err := replayed.Replay(log); err != nil {
+		t.Fatalf("Expected replay to succeed, got %v", err)
+	}
+	if replayed.CurrentState.Name != live.CurrentState.Name {
+		t.Errorf("Expected current state %q, got %q", live.CurrentState.Name, replayed.CurrentState.Name)
+	}
+	expectedActions := []string{"Idle Entry", "Running Entry", "Paused Entry", "Running Entry", "Paused Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check a dry replay reaches the same state without running actions
+	dry := newMachine()
+	resetExecutedActions()
+	if err := dry.DryReplay(log); err != nil {
+		t.Fatalf("Expected dry replay to succeed, got %v", err)
+	}
+	if dry.CurrentState.Name != live.CurrentState.Name {
+		t.Errorf("Expected current state %q, got %q", live.CurrentState.Name, dry.CurrentState.Name)
+	}
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions during a dry replay, got %v", executedActions)
+	}
+
+	// Check an unhandled event is reported
+	if err := newMachine().DryReplay([]string{"start", "start"}); err == nil {
+		t.Errorf("Expected an error for an unhandled event")
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	state1 := State{Name: "state1"}
+	state2 := State{Name: "state2"}
+	state3 := State{Name: "state3"}
+
+	var sm *HierarchicalStateMachine
+	var deferred DispatchResult
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			EventName:    "go",
+			Actions:      []Action{func() { deferred = sm.Dispatch("next") }},
+			NextState:    &state2,
+		},
+		{CurrentState: &state2, EventName: "next", NextState: &state3},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions, WithReentrancyPolicy(ReentrancyQueue))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check an unhandled event
+	result := sm.Dispatch("unknown")
+	expected := DispatchResult{From: &state1}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected result %+v, got %+v", expected, result)
+	}
+
+	// Check a fired transition, whose action dispatches an event that gets deferred
+	result = sm.Dispatch("go")
+	expected = DispatchResult{Fired: true, Transition: &sm.transitions[0], From: &state1, To: &state2}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected result %+v, got %+v", expected, result)
+	}
+	if !reflect.DeepEqual(deferred, DispatchResult{Deferred: true}) {
+		t.Errorf("Expected deferred result, got %+v", deferred)
+	}
+
+	// Check the deferred event ran once the first dispatch finished
+	if sm.CurrentState != &state3 {
+		t.Errorf("Expected current state to be %v, got %v", &state3, sm.CurrentState)
+	}
+}
+
+func TestDispatchStats(t *testing.T) {
+	open := false
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "open", Guards: []Predicate{func() bool { return open }}, NextState: &state2},
+		{CurrentState: &state2, EventName: "close", NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	sm.SendEvent("unknown")
+	sm.SendEvent("open")
+	sm.SendEvent("close")
+	open = true
+	sm.SendEvent("open")
+	sm.SendEvent("close")
+	sm.SendEvent("unknown")
+
+	// Check each outcome was counted
+	expected := DispatchStats{Transitioned: 2, Ignored: 3, GuardBlocked: 1}
+	if stats := sm.DispatchStats(); stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+
+	// Check polls matching nothing aren't counted as ignored
+	for i := 0; i < 5; i++ {
+		sm.Handle()
+	}
+	if stats := sm.DispatchStats(); stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestAcceptedEvents(t *testing.T) {
+	resetExecutedActions()
+
+	idle := State{Exit: []Action{recordAction("Idle Exit")}, AcceptedEvents: []string{"start"}}
+	running := State{}
+	failed := State{}
+
+	transitions := []Transition{
+		{CurrentState: &idle, EventName: "start", NextState: &running},
+		{CurrentState: &idle, EventName: "fail", NextState: &failed},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&idle, []State{idle, running, failed}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	var unhandled []string
+	sm.OnUnhandled(func(current *State, event string) {
+		unhandled = append(unhandled, event)
+	})
+
+	// Check an event outside the allow-list is rejected despite its transition
+	if sm.SendEvent("fail") {
+		t.Errorf("Expected event %q to be rejected", "fail")
+	}
+	if sm.LastHandleOutcome() != EventNotAccepted {
+		t.Errorf("Expected outcome %v, got %v", EventNotAccepted, sm.LastHandleOutcome())
+	}
+	if sm.CurrentState != &idle || len(executedActions) != 0 {
+		t.Errorf("Expected nothing to run, got state %v and actions %v", sm.CurrentState, executedActions)
+	}
+	expected := []string{"fail"}
+	if !reflect.DeepEqual(unhandled, expected) {
+		t.Errorf("Expected unhandled events %v, got %v", expected, unhandled)
+	}
+
+	// Check a listed event still fires
+	if !sm.SendEvent("start") {
+		t.Errorf("Expected event %q to fire a transition", "start")
+	}
+	if sm.CurrentState != &running {
+		t.Errorf("Expected current state to be %v, got %v", &running, sm.CurrentState)
+	}
+
+	// Check the hook also reports events no transition matches
+	sm.SendEvent("unknown")
+	expected = append(expected, "unknown")
+	if !reflect.DeepEqual(unhandled, expected) {
+		t.Errorf("Expected unhandled events %v, got %v", expected, unhandled)
+	}
+}
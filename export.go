@@ -0,0 +1,153 @@
+package hierarchicalStateMachine
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// Tree renders the states as an indented tree following ParentState nesting. Each state is
+// followed by its outgoing transitions and the current state is marked with "<- current".
+func (sm *HierarchicalStateMachine) Tree() string {
+	states := sm.States()
+
+	var b strings.Builder
+	var write func(parent *State, depth int)
+	write = func(parent *State, depth int) {
+		indent := strings.Repeat("  ", depth)
+		for _, state := range states {
+			if state.ParentState != parent {
+				continue
+			}
+			b.WriteString(indent + stateLabel(states, state))
+			if state == sm.CurrentState {
+				b.WriteString(" <- current")
+			}
+			b.WriteString("\n")
+
+			for i := range sm.transitions {
+				transition := &sm.transitions[i]
+				if transition.CurrentState != state {
+					continue
+				}
+				b.WriteString(indent + "  -> " + stateLabel(states, transition.NextState))
+				if transition.EventName != "" {
+					b.WriteString(" on " + transition.EventName)
+				}
+				b.WriteString("\n")
+			}
+
+			write(state, depth+1)
+		}
+	}
+	write(nil, 0)
+
+	return b.String()
+}
+
+// StatePathString returns the names of the current state and its ancestors from the root down,
+// joined by "/", such as "parent2/parent/state1". Unnamed states appear as "#" and their index in
+// States().
+func (sm *HierarchicalStateMachine) StatePathString() string {
+	if sm.CurrentState == nil {
+		return "<nil>"
+	}
+	states := sm.States()
+	var path []string
+	for state, depth := sm.CurrentState, 0; state != nil && depth < MaxStates; state, depth = state.ParentState, depth+1 {
+		path = append([]string{stateLabel(states, state)}, path...)
+	}
+	return strings.Join(path, "/")
+}
+
+// Returns the state's name, or its index among the machine's states when unnamed
+func stateLabel(states []*State, state *State) string {
+	if state == nil {
+		return "<nil>"
+	}
+	if state.Name != "" {
+		return string(state.Name)
+	}
+	for i, known := range states {
+		if known == state {
+			return fmt.Sprintf("#%d", i)
+		}
+	}
+	return "#?"
+}
+
+// AutoName names every unnamed state known to the machine "state#" followed by its index in
+// States(), so logs and exports stay readable without naming every state up front. It fails
+// without naming anything when a generated name is already used by another state.
+func (sm *HierarchicalStateMachine) AutoName() error {
+	states := sm.States()
+	taken := map[StateName]bool{}
+	for _, state := range states {
+		taken[state.Name] = true
+	}
+
+	names := map[*State]StateName{}
+	for i, state := range states {
+		if state.Name != "" {
+			continue
+		}
+		name := StateName(fmt.Sprintf("state#%d", i))
+		if taken[name] {
+			return fmt.Errorf("cannot auto-name state %d: the name %q is already used", i, name)
+		}
+		names[state] = name
+	}
+	for state, name := range names {
+		state.Name = name
+	}
+	return nil
+}
+
+// ToCSV renders the named transitions as a matrix for spreadsheet review: one row per source
+// state, one column per event from AllEvents, and the target's name in each cell, blank when the
+// event does nothing from that state. Targets of guarded transitions are followed by "[guarded]",
+// and a cell with several transitions lists them in evaluation order separated by " | ".
+func (sm *HierarchicalStateMachine) ToCSV() string {
+	states := sm.States()
+	events := sm.AllEvents()
+	column := make(map[string]int, len(events))
+	for i, event := range events {
+		column[event] = i + 1
+	}
+
+	rows := map[*State][]string{}
+	var sources []*State
+	for _, state := range states {
+		for _, transition := range sm.EvaluationOrder(state) {
+			if transition.CurrentState != state || transition.EventName == "" {
+				continue
+			}
+			row, ok := rows[state]
+			if !ok {
+				row = make([]string, len(events)+1)
+				row[0] = stateLabel(states, state)
+				rows[state] = row
+				sources = append(sources, state)
+			}
+
+			target := stateLabel(states, transition.NextState)
+			if len(transition.Guards) > 0 || len(transition.GuardGroups) > 0 || len(transition.VarGuards) > 0 || len(transition.CheckedGuards) > 0 {
+				target += " [guarded]"
+			}
+			cell := &row[column[transition.EventName]]
+			if *cell != "" {
+				*cell += " | "
+			}
+			*cell += target
+		}
+	}
+
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(append([]string{"state"}, events...))
+	for _, state := range sources {
+		w.Write(rows[state])
+	}
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,135 @@
+package hierarchicalStateMachine
+
+import "testing"
+
+func TestTree(t *testing.T) {
+	parentState2 := State{Name: "parent2"}
+	parentState := State{Name: "parent", ParentState: &parentState2}
+	state1 := State{Name: "state1", ParentState: &parentState}
+	state2 := State{Name: "state2", ParentState: &parentState2}
+	state3 := State{Name: "state3"}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "next", NextState: &state2},
+		{CurrentState: &state2, EventName: "leave", NextState: &state3},
+		{CurrentState: &state3, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3, parentState, parentState2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	expected := `parent2
+  parent
+    state1 <- current
+      -> state2 on next
+  state2
+    -> state3 on leave
+state3
+  -> state1
+`
+	if tree := sm.Tree(); tree != expected {
+		t.Errorf("Expected tree\n%s\ngot\n%s", expected, tree)
+	}
+}
+
+func TestStatePathString(t *testing.T) {
+	parent2 := State{Name: "parent2"}
+	parent := State{ParentState: &parent2}
+	state1 := State{Name: "state1", ParentState: &parent}
+	parent2.Initial = &parent
+	parent.Initial = &state1
+
+	sm, err := NewHierarchicalStateMachine(&parent2, []State{parent2, parent, state1}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the unnamed parent is replaced by its index
+	expected := "parent2/#1/state1"
+	if path := sm.StatePathString(); path != expected {
+		t.Errorf("Expected state path %q, got %q", expected, path)
+	}
+
+	parent.Name = "parent"
+	expected = "parent2/parent/state1"
+	if path := sm.StatePathString(); path != expected {
+		t.Errorf("Expected state path %q, got %q", expected, path)
+	}
+}
+
+func TestAutoName(t *testing.T) {
+	root := State{}
+	parent := State{ParentState: &root}
+	state1 := State{Name: "state1", ParentState: &parent}
+	root.Initial = &parent
+	parent.Initial = &state1
+
+	sm, err := NewHierarchicalStateMachine(&root, []State{root, parent, state1}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check unnamed states get their index and named ones are kept
+	if err := sm.AutoName(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := "state#0/state#1/state1"
+	if path := sm.StatePathString(); path != expected {
+		t.Errorf("Expected state path %q, got %q", expected, path)
+	}
+
+	// Check the names are stable when run again
+	if err := sm.AutoName(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if path := sm.StatePathString(); path != expected {
+		t.Errorf("Expected state path %q, got %q", expected, path)
+	}
+}
+
+func TestAutoNameCollision(t *testing.T) {
+	state1 := State{Name: "state#1"}
+	state2 := State{}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, []Transition{{CurrentState: &state1, NextState: &state2}})
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check a generated name colliding with an existing one is rejected
+	if err := sm.AutoName(); err == nil {
+		t.Errorf("Expected an error for a colliding name, got nil")
+	}
+	if state2.Name != "" {
+		t.Errorf("Expected the state to stay unnamed, got %q", state2.Name)
+	}
+}
+
+func TestToCSV(t *testing.T) {
+	idle := State{Name: "idle"}
+	running := State{Name: "running"}
+	failed := State{Name: "failed"}
+
+	transitions := []Transition{
+		{CurrentState: &idle, EventName: "start", NextState: &running},
+		{CurrentState: &running, EventName: "fail", Guards: []Predicate{func() bool { return true }}, NextState: &failed},
+		{CurrentState: &running, EventName: "fail", NextState: &idle},
+		{CurrentState: &running, EventName: "stop", NextState: &idle},
+		{CurrentState: &failed, Event: func() bool { return true }, NextState: &idle},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&idle, []State{idle, running, failed}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the header lists every event and the cells hold the targets
+	expected := "state,fail,start,stop\n" +
+		"idle,,running,\n" +
+		"running,failed [guarded] | idle,,idle\n"
+	if csv := sm.ToCSV(); csv != expected {
+		t.Errorf("Expected CSV\n%s\ngot\n%s", expected, csv)
+	}
+}
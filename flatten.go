@@ -0,0 +1,224 @@
+package hierarchicalStateMachine
+
+// Flatten returns an equivalent machine without ParentState links, for tools that only understand
+// flat machines. Every state that can be current becomes a flat state with the Handle actions and
+// consumers of its hierarchy inlined. Each transition becomes one flat transition per state it
+// can settle in, whose Actions run the Exit actions, the original Actions and the Entry actions in
+// the order the hierarchical machine runs them, so the flat states have no Entry or Exit of their
+// own. CheckedActions stay checked, with the Entry actions moved after them so a failure still
+// skips the entries. The guards of InitialChoices are added to the guards of these transitions, so unlike the
+// hierarchical machine they are evaluated before anything exits.
+//
+// The new machine starts in the state the original initial state settles in now, running the
+// Entry actions of that path. Machine options, DoActivity, EntryWithReason and callbacks such as
+// OnRegionEnter are not carried over.
+func (sm *HierarchicalStateMachine) Flatten() *HierarchicalStateMachine {
+	flat := map[*State]*State{}
+	var order []*State
+	flatState := func(state *State) *State {
+		if flattened, ok := flat[state]; ok {
+			return flattened
+		}
+		flattened := &State{
+			Name:            state.Name,
+			Handle:          inheritedHandle(state),
+			HandleConsumers: inheritedConsumers(state),
+		}
+		flat[state] = flattened
+		order = append(order, state)
+		return flattened
+	}
+
+	var transitions []Transition
+	compile := func(transition *Transition, from *State) {
+		commonAncestor := findCommonAncestor(transition.CurrentState, transition.NextState)
+
+		var exits []Action
+		crossed := 0
+		if !transition.SkipExit {
+			crossed = crossedLevels(from, commonAncestor)
+		}
+		actions := append([]Action(nil), transition.Actions...)
+		for _, action := range transition.ActionsWithDepth {
+			action := action
+			actions = append(actions, func() { action(crossed) })
+		}
+		for state := from; state != commonAncestor && !transition.SkipExit; state = state.ParentState {
+			if !state.ReverseExitOrder {
+				exits = append(exits, state.Exit...)
+			} else {
+				for i := len(state.Exit) - 1; i >= 0; i-- {
+					exits = append(exits, state.Exit[i])
+				}
+			}
+			exits = append(exits, transition.PathActions[state]...)
+		}
+
+		paths := []entryPath{{settle: transition.NextState}}
+		if !transition.SkipEntry {
+			paths = entryPaths(transition.NextState, commonAncestor, transition.PathActions)
+		}
+		for _, path := range paths {
+			compiled := *transition
+			compiled.CurrentState = flatState(from)
+			compiled.NextState = flatState(path.settle)
+			compiled.Guards = append(append([]Predicate(nil), transition.Guards...), path.guards...)
+			if transition.InvertGuards {
+				// The guards of the initial choices must not be inverted with the transition's own
+				original := transition
+				compiled.Guards = append([]Predicate{func() bool { return guardsPassed(original) }}, path.guards...)
+				compiled.GuardGroups, compiled.InvertGuards = nil, false
+			}
+			compiled.Actions = append(append(append([]Action(nil), exits...), actions...), path.actions...)
+			if len(transition.CheckedActions) > 0 {
+				// The entries must follow the checked actions and be skipped when one fails
+				compiled.Actions = append(append([]Action(nil), exits...), actions...)
+				compiled.CheckedActions = append(append([]func() error(nil), transition.CheckedActions...), unchecked(path.actions)...)
+			}
+			compiled.SkipExit, compiled.SkipEntry, compiled.FromDescendants = false, false, false
+			compiled.PathActions, compiled.ActionsWithDepth = nil, nil
+			transitions = append(transitions, compiled)
+		}
+	}
+
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if transition.CurrentState != nil && transition.NextState != nil && transition.CurrentState.Initial == nil {
+			compile(transition, transition.CurrentState)
+		}
+	}
+
+	// Transitions from descendants are copied to every leaf below their composite, after the
+	// leaves' own transitions so they are still evaluated last
+	states := sm.States()
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if !transition.FromDescendants || transition.CurrentState == nil || transition.NextState == nil {
+			continue
+		}
+		for _, state := range states {
+			if state.Initial == nil && isDescendant(state, transition.CurrentState) {
+				compile(transition, state)
+			}
+		}
+	}
+
+	// The initial path is entered once at construction, so its actions only belong to the initial
+	// state until then
+	initial := sm.initialState
+	initialActions := pathEntries(initial, nil, nil)
+	for i := 0; i < MaxStates; i++ {
+		child := initialDescendant(initial)
+		if child == nil {
+			break
+		}
+		initialActions = append(initialActions, pathEntries(child, initial, nil)...)
+		initial = child
+	}
+	flatInitial := flatState(initial)
+	flatInitial.Entry = initialActions
+
+	values := make([]State, 0, len(order))
+	for _, state := range order {
+		values = append(values, *flat[state])
+	}
+	flattened, err := NewHierarchicalStateMachine(flatInitial, values, transitions)
+	flatInitial.Entry = nil
+	if err != nil {
+		// The flat machine has no more states or stricter rules than the original
+		panic("hierarchicalStateMachine: flattening produced an invalid machine: " + err.Error())
+	}
+	return flattened
+}
+
+// entryPath is one way of entering a state: the Entry actions run, the state settled in, and the
+// guards of the initial choices that lead there
+type entryPath struct {
+	actions []Action
+	settle  *State
+	guards  []Predicate
+}
+
+// Returns every way of entering the state from (not including) the common ancestor, following
+// initial descendants and splitting on initial choices in the order they are tried. The path
+// actions of the transition run after the Entry actions of their state.
+func entryPaths(state, commonAncestor *State, pathActions map[*State][]Action) []entryPath {
+	entries := pathEntries(state, commonAncestor, pathActions)
+	if state.Initial == nil {
+		return []entryPath{{actions: entries, settle: state}}
+	}
+
+	var paths []entryPath
+	var earlier []Predicate
+	addChoice := func(child *State, guards []Predicate) {
+		for _, sub := range entryPaths(child, state, pathActions) {
+			paths = append(paths, entryPath{
+				actions: append(append([]Action(nil), entries...), sub.actions...),
+				settle:  sub.settle,
+				guards:  append(append([]Predicate(nil), guards...), sub.guards...),
+			})
+		}
+	}
+	for _, choice := range state.InitialChoices {
+		guards := append([]Predicate(nil), earlier...)
+		if choice.Guard == nil {
+			addChoice(choice.State, guards)
+			return paths
+		}
+		addChoice(choice.State, append(guards, choice.Guard))
+		earlier = append(earlier, not(choice.Guard))
+	}
+	addChoice(state.Initial, earlier)
+	return paths
+}
+
+// Returns the Entry actions, each state's followed by its path actions, from (not including) the
+// common ancestor down to the state
+func pathEntries(state, commonAncestor *State, pathActions map[*State][]Action) []Action {
+	var entries []Action
+	for ; state != commonAncestor; state = state.ParentState {
+		entries = append(append(append([]Action(nil), state.Entry...), pathActions[state]...), entries...)
+	}
+	return entries
+}
+
+// Returns the actions as checked actions that never fail
+func unchecked(actions []Action) []func() error {
+	checked := make([]func() error, len(actions))
+	for i, action := range actions {
+		action := action
+		checked[i] = func() error {
+			action()
+			return nil
+		}
+	}
+	return checked
+}
+
+// Returns the Handle actions run for the state, parent first
+func inheritedHandle(state *State) []Action {
+	if state == nil {
+		return nil
+	}
+	var handle []Action
+	if !state.SkipAncestorHandle {
+		handle = inheritedHandle(state.ParentState)
+	}
+	return append(handle, state.Handle...)
+}
+
+// Returns the HandleConsumers run for the state, parent first
+func inheritedConsumers(state *State) []func() bool {
+	if state == nil {
+		return nil
+	}
+	var consumers []func() bool
+	if !state.SkipAncestorHandle {
+		consumers = inheritedConsumers(state.ParentState)
+	}
+	return append(consumers, state.HandleConsumers...)
+}
+
+func not(predicate Predicate) Predicate {
+	return func() bool { return !predicate() }
+}
@@ -0,0 +1,77 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	parentA := State{
+		Name:   "parentA",
+		Entry:  []Action{recordAction("Parent A Entry")},
+		Exit:   []Action{recordAction("Parent A Exit")},
+		Handle: []Action{recordAction("Parent A Handle")},
+	}
+	stateA := State{
+		Name:        "stateA",
+		ParentState: &parentA,
+		Entry:       []Action{recordAction("State A Entry")},
+		Exit:        []Action{recordAction("State A Exit")},
+		Handle:      []Action{recordAction("State A Handle")},
+	}
+	parentB := State{Name: "parentB", Entry: []Action{recordAction("Parent B Entry")}}
+	stateB1 := State{Name: "stateB1", ParentState: &parentB, Entry: []Action{recordAction("State B1 Entry")}}
+	stateB2 := State{Name: "stateB2", ParentState: &parentB, Entry: []Action{recordAction("State B2 Entry")}}
+	parentA.Initial = &stateA
+	parentB.Initial = &stateB1
+
+	useB2 := false
+	parentB.InitialChoices = []InitialChoice{{Guard: func() bool { return useB2 }, State: &stateB2}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &stateA,
+			Actions:      []Action{recordAction("A -> B Transition")},
+			NextState:    &parentB,
+		},
+	}
+
+	run := func(build func() *HierarchicalStateMachine) ([]string, StateName) {
+		resetExecutedActions()
+		sm := build()
+		HandleStateMachine(sm)
+		return append([]string(nil), executedActions...), sm.CurrentState.Name
+	}
+	hierarchical := func() *HierarchicalStateMachine {
+		sm, err := NewHierarchicalStateMachine(&parentA, []State{parentA, stateA, parentB, stateB1, stateB2}, transitions)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm
+	}
+
+	for _, b2 := range []bool{false, true} {
+		useB2 = b2
+		expectedActions, expectedState := run(hierarchical)
+
+		// Check the flat machine runs the same actions and settles in the same state
+		var flat *HierarchicalStateMachine
+		actions, state := run(func() *HierarchicalStateMachine {
+			flat = hierarchical().Flatten()
+			resetExecutedActions()
+			return flat
+		})
+		if !reflect.DeepEqual(actions, expectedActions[2:]) {
+			t.Errorf("Expected flat actions %v, got %v", expectedActions[2:], actions)
+		}
+		if state != expectedState {
+			t.Errorf("Expected flat machine to settle in %q, got %q", expectedState, state)
+		}
+
+		for _, flatState := range flat.States() {
+			if flatState.ParentState != nil {
+				t.Errorf("Expected no parent for flat state %q", flatState.Name)
+			}
+		}
+	}
+}
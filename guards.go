@@ -0,0 +1,96 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"time"
+)
+
+// MinTimeInState returns a guard that passes once the machine has been in its current state for
+// at least d, measured with the machine's clock
+func MinTimeInState(sm *HierarchicalStateMachine, d time.Duration) Predicate {
+	return func() bool {
+		return sm.TimeInState() >= d
+	}
+}
+
+// VarEquals returns a guard that passes while the extended state variable key is set and deeply
+// equal to expected. Declare the condition in VarGuards instead for GuardConflicts to compare it.
+func VarEquals(sm *HierarchicalStateMachine, key string, expected interface{}) Predicate {
+	return func() bool {
+		return sm.varHolds(VarCondition{Key: key, Value: expected})
+	}
+}
+
+// VarCondition requires the extended state variable Key to be set and deeply equal to Value
+type VarCondition struct {
+	Key   string
+	Value interface{}
+}
+
+// Reports whether the extended state satisfies the condition
+func (sm *HierarchicalStateMachine) varHolds(condition VarCondition) bool {
+	v, ok := sm.GetVar(condition.Key)
+	return ok && reflect.DeepEqual(v, condition.Value)
+}
+
+// Reports whether every VarGuards condition of the transition holds
+func (sm *HierarchicalStateMachine) varGuardsPassed(transition *Transition) bool {
+	for _, condition := range transition.VarGuards {
+		if !sm.varHolds(condition) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the conditions can all hold at once: none requires two different values of the
+// same variable
+func satisfiable(conditions []VarCondition) bool {
+	for i := range conditions {
+		for j := i + 1; j < len(conditions); j++ {
+			if conditions[i].Key == conditions[j].Key && !reflect.DeepEqual(conditions[i].Value, conditions[j].Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FieldTrue returns a guard that passes while *ptr is true, read on every evaluation
+func FieldTrue(ptr *bool) Predicate {
+	return func() bool {
+		return *ptr
+	}
+}
+
+// FieldEquals returns a guard that passes while *ptr equals want, read on every evaluation
+func FieldEquals[T comparable](ptr *T, want T) Predicate {
+	return func() bool {
+		return *ptr == want
+	}
+}
+
+// WithinWindow returns a guard that passes while the clock reads a time in [start, end)
+func WithinWindow(clock Clock, start, end time.Time) Predicate {
+	return func() bool {
+		now := clock.Now()
+		return !now.Before(start) && now.Before(end)
+	}
+}
+
+// DuringDailyWindow returns a guard that passes while the clock's time of day, in the location of
+// the time it returns, is in [from, to), such as business hours. A window with to before from
+// wraps past midnight.
+func DuringDailyWindow(clock Clock, from, to time.Duration) Predicate {
+	return func() bool {
+		// Taken from the wall clock, since days changing to or from daylight saving time don't
+		// last 24 hours
+		now := clock.Now()
+		offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+			time.Duration(now.Second())*time.Second + time.Duration(now.Nanosecond())
+		if from <= to {
+			return offset >= from && offset < to
+		}
+		return offset >= from || offset < to
+	}
+}
@@ -0,0 +1,253 @@
+package hierarchicalStateMachine
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestMinTimeInState(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	// Guards are built on use since the machine doesn't exist yet when transitions are declared
+	var sm *HierarchicalStateMachine
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Guards:       []Predicate{func() bool { return MinTimeInState(sm, time.Second)() }},
+			NextState:    &state2,
+		},
+		{
+			CurrentState: &state2,
+			Guards:       []Predicate{func() bool { return MinTimeInState(sm, time.Second)() }},
+			NextState:    &state3,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions, WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the guard blocks until the dwell elapses
+	clock.Advance(999 * time.Millisecond)
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+
+	clock.Advance(time.Millisecond)
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check the dwell restarts on entering the new state
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestVarGuards(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "go", VarGuards: []VarCondition{{Key: "approved", Value: true}}, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the transition is blocked until the var has the required value
+	if sm.SendEvent("go") {
+		t.Errorf("Expected event %q not to fire a transition", "go")
+	}
+	sm.SetVar("approved", false)
+	if sm.SendEvent("go") {
+		t.Errorf("Expected event %q not to fire a transition", "go")
+	}
+	sm.SetVar("approved", true)
+	if !sm.SendEvent("go") || sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestVarEquals(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	var sm *HierarchicalStateMachine
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Actions:      []Action{func() { sm.SetVar("approved", true) }},
+			NextState:    &state2,
+		},
+		{
+			CurrentState: &state2,
+			Guards:       []Predicate{func() bool { return VarEquals(sm, "approved", true)() }},
+			NextState:    &state3,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check an unset var fails the guard
+	if VarEquals(sm, "approved", true)() {
+		t.Errorf("Expected guard on an unset var to fail")
+	}
+
+	HandleStateMachine(sm)
+	if v, ok := sm.GetVar("approved"); !ok || v != true {
+		t.Errorf("Expected var %q to be set by the action, got %v", "approved", v)
+	}
+
+	// Check the guard reads the var set by the earlier action
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state3 {
+		t.Errorf("Expected current state to be %v, got %v", &state3, sm.CurrentState)
+	}
+}
+
+func TestFieldGuards(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	canTransition := false
+	mode := "manual"
+	transitions := []Transition{
+		{CurrentState: &state1, Guards: []Predicate{FieldTrue(&canTransition)}, NextState: &state2},
+		{CurrentState: &state2, Guards: []Predicate{FieldEquals(&mode, "auto")}, NextState: &state3},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check flipping the bool allows the transition
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+	canTransition = true
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check the compared value is read live
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+	mode = "auto"
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state3 {
+		t.Errorf("Expected current state to be %v, got %v", &state3, sm.CurrentState)
+	}
+}
+
+func TestWithinWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start.Add(-time.Minute)}
+
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, Guards: []Predicate{WithinWindow(clock, start, start.Add(time.Hour))}, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the guard blocks before the window
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+
+	// Check the guard passes inside the window
+	clock.Advance(time.Minute)
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check the end of the window is excluded
+	clock.Advance(time.Hour)
+	if WithinWindow(clock, start, start.Add(time.Hour))() {
+		t.Errorf("Expected the guard to fail at the end of the window")
+	}
+}
+
+func TestDuringDailyWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)}
+	businessHours := DuringDailyWindow(clock, 9*time.Hour, 17*time.Hour)
+	overnight := DuringDailyWindow(clock, 22*time.Hour, 6*time.Hour)
+
+	closed := State{}
+	open := State{}
+
+	transitions := []Transition{
+		{CurrentState: &closed, EventName: "open", Guards: []Predicate{businessHours}, NextState: &open},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&closed, []State{closed, open}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the guard blocks outside business hours
+	if sm.SendEvent("open") {
+		t.Errorf("Expected event %q not to fire a transition", "open")
+	}
+
+	// Check the guard passes on a later day inside business hours
+	clock.Advance(24*time.Hour + 2*time.Hour)
+	if !sm.SendEvent("open") {
+		t.Errorf("Expected event %q to fire a transition", "open")
+	}
+
+	// Check a window wrapping midnight
+	if overnight() {
+		t.Errorf("Expected the overnight window to be closed at 10:00")
+	}
+	clock.Advance(15 * time.Hour)
+	if !overnight() {
+		t.Errorf("Expected the overnight window to be open at 01:00")
+	}
+
+	// Check the time of day is read from the wall clock on a day daylight saving time starts
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	clock.now = time.Date(2024, 3, 10, 9, 30, 0, 0, newYork)
+	if !businessHours() {
+		t.Errorf("Expected business hours to be open at 09:30 on the day clocks go forward")
+	}
+}
@@ -1,6 +1,12 @@
 package hierarchicalStateMachine
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
 
 const MaxStates = 10 // MaxStates is used to create fixed-size arrays to avoid heap allocation
 
@@ -14,87 +20,1625 @@ type State struct {
 	Exit        []Action
 	Handle      []Action
 	ParentState *State
+
+	// Initial is the descendant entered when a transition targets this state. InitialChoices are
+	// tried in order first, entering the first whose guard passes, with Initial as the default.
+	Initial        *State
+	InitialChoices []InitialChoice
+
+	// AcceptedEvents, when not empty, is the only vocabulary of named events the state accepts
+	// while current. Any other event is rejected with the EventNotAccepted outcome and passed to
+	// the OnUnhandled hook without evaluating transitions, even ones declared for it.
+	AcceptedEvents []string
+
+	// By default HandleStateMachine runs the Handle actions of the whole current hierarchy, parent
+	// first. SkipAncestorHandle stops inherited handling above this state.
+	SkipAncestorHandle bool
+
+	// HandleConsumers run after the Handle actions, in the same order. If one returns true the
+	// input was consumed and no transitions are evaluated for this call.
+	HandleConsumers []func() bool
+
+	// ParallelEntry runs the Entry actions of this state concurrently. Entry of the next level of
+	// the hierarchy only starts once all of them have returned. Each action gets the entry
+	// PanicPolicy and action log entry of its own, and is run through the executor by itself.
+	ParallelEntry bool
+
+	// DoActivity is started in its own goroutine once the state has been entered. Its context is
+	// cancelled when the state is exited, before the Exit actions run, and the machine waits up to
+	// the activity stop timeout for it to return.
+	DoActivity func(ctx context.Context)
+
+	// EntryWithReason run after the Entry actions and are told why the state is being entered
+	EntryWithReason []func(reason EntryReason)
+
+	// Exit actions run in slice order by default. ReverseExitOrder runs them last to first, to
+	// release resources in the reverse of the order Entry acquired them.
+	ReverseExitOrder bool
+}
+
+// EntryReason tells EntryWithReason callbacks why their state is being entered
+type EntryReason int
+
+const (
+	EntryNormal  EntryReason = iota // On the path to the target of a transition
+	EntryInitial                    // As the initial state of the machine or of a composite
+)
+
+// InitialChoice is a guarded candidate for the initial descendant of a composite state
+type InitialChoice struct {
+	Guard Predicate
+	State *State
+}
+
+type Transition struct {
+	CurrentState *State
+	EventName    string // Fires the transition on SendEvent. Without an Event it is not polled by HandleStateMachine.
+	Event        Predicate
+	Guards       []Predicate
+	GuardGroups  [][]Predicate // Eligible if any group fully passes (OR across groups, AND within)
+	Vetoes       []Predicate   // Checked once selected, before any Exit; returning false aborts the whole handle
+	Actions      []Action
+	NextState    *State
+	OnComplete   func() // Runs once after the whole entry chain of NextState, with CurrentState already updated
+	Priority     int    // Used by the HighestPriority duplicate policy, higher wins
+	CrossTree    bool   // Allows the transition under WithStrictAncestry when source and target share no ancestor
+
+	// SkipExit and SkipEntry silently move CurrentState without running the Exit actions of the
+	// source hierarchy or the Entry actions of the target hierarchy; Actions still run. The
+	// DoActivity of each state left is still stopped. SkipEntry also skips initial descendants,
+	// leaving the machine exactly in NextState. Only use these for
+	// corrections where the skipped actions are known to be unnecessary, since states relying on
+	// their Entry/Exit pairing for setup and cleanup will otherwise be left inconsistent.
+	SkipExit  bool
+	SkipEntry bool
+
+	// FromDescendants makes a transition from a composite also fire while the machine is in any of
+	// its descendants, after the transitions of the current state, such as "any error inside the
+	// payment region goes to failed". Exit actions run from the current state up.
+	FromDescendants bool
+
+	// CheckedGuards must all pass like Guards, but may report that they could not decide. The
+	// error is handled by the machine's GuardErrorPolicy.
+	CheckedGuards []func() (bool, error)
+
+	// VarGuards must all pass like Guards, each requiring an extended state variable set with
+	// SetVar to equal a value. Being declared rather than closures, GuardConflicts can compare
+	// them. They are checked after Guards and GuardGroups and, like CheckedGuards, not inverted.
+	VarGuards []VarCondition
+
+	// TargetPrecondition checks that NextState is ready to be entered, once the transition is
+	// selected and its Vetoes passed but before any Exit. If it returns false the transition is
+	// skipped with nothing run, leaving the machine in its source state.
+	TargetPrecondition Predicate
+
+	// PathActions run when this transition exits or enters the keyed state, after that state's own
+	// Exit or Entry actions, for behaviour specific to the transition at an intermediate level of
+	// its path
+	PathActions map[*State][]Action
+
+	// OnEntry transitions are not fired by events or polls. They are evaluated once, right after
+	// a transition settles in CurrentState, and the first whose guards, Vetoes and
+	// TargetPrecondition pass fires within the same dispatch, for "enter then branch" logic.
+	// Event and EventName are ignored.
+	OnEntry bool
+
+	// InvertGuards negates the combined result of Guards and GuardGroups, so the transition fires
+	// unless they pass. VarGuards and CheckedGuards are not inverted and must still pass.
+	InvertGuards bool
+
+	// Debounce ignores the transition for this long after it fired, measured with the machine's
+	// clock, to avoid flapping on noisy inputs. Other transitions are still evaluated.
+	Debounce time.Duration
+
+	// CurrentStates are further sources of the transition, alongside CurrentState, to avoid
+	// declaring the same transition for several states. The machine keeps one copy of the
+	// transition per source, each with only CurrentState set, in declaration order.
+	CurrentStates []*State
+
+	// AsyncGuards must all pass like CheckedGuards, but may block on I/O. They are only awaited by
+	// Run, with its context, after every other guard passed. Any other dispatch that reaches them
+	// fails with ErrAsyncGuardOutsideRun.
+	AsyncGuards []AsyncGuard
+
+	// ActionsWithDepth run after Actions and are told how many composite levels the transition
+	// left: 0 when only the source state exits, such as between siblings, and one more for every
+	// ancestor exited above it
+	ActionsWithDepth []func(crossedLevels int)
+
+	// ElseActions run when the transition's event occurred but its guards blocked it and no other
+	// transition fired, to react to a refused attempt, such as "balance too low", without changing
+	// state
+	ElseActions []Action
+
+	// CheckedActions run after Actions and ActionsWithDepth, in order, and may fail. An error
+	// abandons the transition before any Entry, leaving the machine in its source state with its
+	// Exit actions already run, and is returned by the dispatch. WithTransactionalRTC reverts the
+	// whole dispatch instead. An executor set by WithExecutor must have run each one when its Run
+	// returns. They can't be buffered, so machines with WithDeferredExecution reject them.
+	CheckedActions []func() error
+}
+
+// Clock supplies the current time, so time-based behaviour can be tested with a fake
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// HandleOutcome describes what the last call to HandleStateMachine or SendEvent did
+type HandleOutcome int
+
+const (
+	NotHandled         HandleOutcome = iota // HandleStateMachine has not been called yet
+	Transitioned                            // A transition fired
+	NoMatchingEvent                         // No transition from the current state had its event occur
+	GuardBlocked                            // An event occurred but the guards of every such transition failed
+	Vetoed                                  // A transition was selected but one of its Vetoes aborted it
+	Consumed                                // A HandleConsumer absorbed the call before transitions were evaluated
+	GuardErrored                            // A checked or async guard failed under GuardErrorAbort or GuardErrorRoute, or async guards were reached outside Run
+	PreconditionFailed                      // A Precondition returned an error before anything ran
+	Panicked                                // An action panicked under RouteToErrorState
+	TargetNotReady                          // A transition was selected but its TargetPrecondition failed
+	Locked                                  // The machine was locked with Lock, so nothing was evaluated
+	EventNotAccepted                        // The event is not in the AcceptedEvents of the current state
+	Cancelled                               // A transition was selected but the BeforeTransition hook cancelled it
+	ActionFailed                            // One of the CheckedActions of a transition returned an error
+)
+
+func (o HandleOutcome) String() string {
+	switch o {
+	case NotHandled:
+		return "NotHandled"
+	case Transitioned:
+		return "Transitioned"
+	case NoMatchingEvent:
+		return "NoMatchingEvent"
+	case GuardBlocked:
+		return "GuardBlocked"
+	case Vetoed:
+		return "Vetoed"
+	case Consumed:
+		return "Consumed"
+	case GuardErrored:
+		return "GuardErrored"
+	case PreconditionFailed:
+		return "PreconditionFailed"
+	case Panicked:
+		return "Panicked"
+	case TargetNotReady:
+		return "TargetNotReady"
+	case Locked:
+		return "Locked"
+	case EventNotAccepted:
+		return "EventNotAccepted"
+	case Cancelled:
+		return "Cancelled"
+	case ActionFailed:
+		return "ActionFailed"
+	}
+	return fmt.Sprintf("HandleOutcome(%d)", int(o))
+}
+
+// DuplicatePolicy decides how transitions sharing a source state and event are resolved
+type DuplicatePolicy int
+
+const (
+	FirstMatch      DuplicatePolicy = iota // The first eligible transition in declaration order fires (default)
+	Error                                  // Construction fails if two transitions could both be eligible
+	HighestPriority                        // The eligible transition with the highest Priority fires, ties broken by WithTieBreaker
+)
+
+// ReentrancyPolicy decides what happens when an action calls HandleStateMachine or SendEvent on
+// its own machine
+type ReentrancyPolicy int
+
+const (
+	ReentrancyPanic ReentrancyPolicy = iota // Panic with a clear message (default)
+	ReentrancyQueue                         // Run the call once the current one has finished
+)
+
+// EventPropagation decides which ancestor transitions a named event reaches when the current
+// state's own transitions don't handle it
+type EventPropagation int
+
+const (
+	PropagationLeafOnly EventPropagation = iota // Only ancestor transitions with FromDescendants (default)
+	PropagationBubbling                         // Every ancestor transition, nearest ancestor first, stopping at the first that fires
+)
+
+// GuardErrorPolicy decides what happens when a CheckedGuards or AsyncGuards function returns an
+// error
+type GuardErrorPolicy int
+
+const (
+	GuardErrorSkip  GuardErrorPolicy = iota // Treat the guard as failed and keep looking (default)
+	GuardErrorAbort                         // Stop without transitioning and return the error from Handle
+	GuardErrorRoute                         // Move to the state set by WithErrorState
+)
+
+type HierarchicalStateMachine struct {
+	CurrentState        *State
+	initialState        *State
+	unentered           bool // The initial state is entered on the first dispatch, for parsed machines
+	states              []State
+	transitions         []Transition
+	declaredTransitions int        // Before expandSources, for Counts
+	mu                  sync.Mutex // Guards the metrics below and CurrentState updates, for readers on other goroutines
+	transitionCounts    map[*Transition]int
+	lastFired           map[*Transition]time.Time // For transitions with a Debounce
+	dispatchStats       DispatchStats
+	locked              bool
+	enteredAt           time.Time
+	clock               Clock
+	lastOutcome         HandleOutcome
+	preHandle           func(current *State)
+	beforeTransition    func(t *Transition) bool
+	onUnhandled         func(current *State, event string)
+	postHandle          func(current *State, fired *Transition)
+	userContext         interface{}
+	vars                map[string]interface{}
+
+	deferredExecution  bool
+	buffering          bool
+	pendingActions     []Action
+	pendingTransitions []*Transition
+	pendingFrom        *State
+	pendingEnteredAt   time.Time
+	pendingVisits      []*State // States first entered by the buffered transitions, reverted by Discard
+
+	handling         bool
+	reentrancyPolicy ReentrancyPolicy
+	queued           []trigger
+	eventAliases     map[string]string
+	duplicatePolicy  DuplicatePolicy
+	propagation      EventPropagation
+	tieBreaker       func(a, b *Transition) bool
+	strictAncestry   bool
+
+	autoCompleteEvent string
+	guardErrorPolicy  GuardErrorPolicy
+	errorState        *State
+	dryReplay         bool // Drops every action instead of running it
+
+	preconditions       []func() error
+	registry            *Registry // Resolves the guards of parsed machines
+	actionLog           *actionLog
+	visited             map[*State]bool
+	firstEnter          map[StateName][]Action
+	regionEnters        map[*State]Action
+	regionExits         map[*State]Action
+	tracingGuards       bool
+	checkingPurity      bool
+	impureGuards        []*Transition
+	pathActions         map[*State][]Action // PathActions of the transition being executed
+	executor            ActionExecutor
+	runCtx              context.Context // Set while Run dispatches, for AsyncGuards
+	running             *runLoop        // Set while Run drives the machine, guarded by mu
+	guardTrace          []GuardEval
+	blocked             []*Transition // Blocked transitions with ElseActions in the current dispatch
+	panicPolicies       [phaseCount]PanicPolicy
+	routing             bool // Entering the error state after a panic, where RouteToErrorState recovers instead
+	transactionalRTC    bool
+	rtcFired            []firedTransition // The transitions fired by the current dispatch, to revert its bookkeeping
+	activities          map[*State]activity
+	activityStopTimeout time.Duration
+
+	lifecycle        chan LifecycleEvent
+	lifecycleBuffer  int
+	lifecycleDropped int
+
+	observers          []func(from, to *State)
+	coalesceObservers  bool
+	changedSinceSettle bool // A transition fired during the current dispatch, for coalesced observers
+}
+
+func NewHierarchicalStateMachine(initialState *State, states []State, transitions []Transition, opts ...Option) (*HierarchicalStateMachine, error) {
+	if len(states) > MaxStates {
+		return nil, fmt.Errorf("too many states declared: %d. max allowed is %d", len(states), MaxStates)
+	}
+	sm := &HierarchicalStateMachine{
+		CurrentState:        initialState,
+		initialState:        initialState,
+		states:              states,
+		transitions:         expandSources(transitions),
+		declaredTransitions: len(transitions),
+		transitionCounts:    make(map[*Transition]int, len(transitions)),
+		clock:               realClock{},
+		activityStopTimeout: DefaultActivityStopTimeout,
+		lifecycleBuffer:     DefaultLifecycleBuffer,
+	}
+	for i := range sm.transitions {
+		sm.transitionCounts[&sm.transitions[i]] = 0
+	}
+	for _, opt := range opts {
+		opt(sm)
+	}
+	sm.enteredAt = sm.clock.Now()
+
+	for _, state := range sm.States() {
+		if err := validateInitial(state); err != nil {
+			return nil, err
+		}
+		if err := validateStateFuncs(state); err != nil {
+			return nil, err
+		}
+	}
+	for i := range sm.transitions {
+		if err := validateTransitionFuncs(&sm.transitions[i]); err != nil {
+			return nil, fmt.Errorf("transition %d: %v", i, err)
+		}
+		if sm.deferredExecution && len(sm.transitions[i].CheckedActions) > 0 {
+			return nil, fmt.Errorf("transition %d: checked actions can't be deferred", i)
+		}
+	}
+	if sm.duplicatePolicy == Error {
+		if err := sm.checkDuplicates(); err != nil {
+			return nil, err
+		}
+	}
+	if sm.guardErrorPolicy == GuardErrorRoute && sm.errorState == nil {
+		return nil, fmt.Errorf("guard error policy routes to an error state but none was set")
+	}
+	for phase, policy := range sm.panicPolicies {
+		if policy == RouteToErrorState && sm.errorState == nil {
+			return nil, fmt.Errorf("panic policy for %v actions routes to an error state but none was set", Phase(phase))
+		}
+	}
+	if sm.strictAncestry {
+		for _, transition := range sm.UnrelatedTransitions() {
+			if !transition.CrossTree {
+				return nil, fmt.Errorf("transition from %q to %q crosses unrelated state trees", stateName(transition.CurrentState), stateName(transition.NextState))
+			}
+		}
+	}
+
+	// Execute all entry actions in current state hierarchy
+	if !sm.unentered {
+		sm.routingPanics(func() { sm.CurrentState = sm.enterFromCommonAncestor(sm.CurrentState, nil, EntryInitial) })
+	}
+
+	return sm, nil
+}
+
+// Returns the transitions with one copy per source for those with CurrentStates, or the
+// transitions themselves when none has any
+func expandSources(transitions []Transition) []Transition {
+	expand := false
+	for i := range transitions {
+		expand = expand || len(transitions[i].CurrentStates) > 0
+	}
+	if !expand {
+		return transitions
+	}
+
+	var expanded []Transition
+	for _, transition := range transitions {
+		sources := transition.CurrentStates
+		if transition.CurrentState != nil || len(sources) == 0 {
+			sources = append([]*State{transition.CurrentState}, sources...)
+		}
+		transition.CurrentStates = nil
+		for i, source := range sources {
+			if containsState(sources[:i], source) {
+				continue
+			}
+			transition.CurrentState = source
+			expanded = append(expanded, transition)
+		}
+	}
+	return expanded
+}
+
+// NewHierarchicalStateMachineFunc evaluates initialSelector to choose the initial state, for
+// machines whose starting point depends on runtime conditions such as resuming work
+func NewHierarchicalStateMachineFunc(initialSelector func() *State, states []State, transitions []Transition, opts ...Option) (*HierarchicalStateMachine, error) {
+	initialState := initialSelector()
+	if initialState == nil {
+		return nil, fmt.Errorf("initial state selector returned no state")
+	}
+	return NewHierarchicalStateMachine(initialState, states, transitions, opts...)
+}
+
+// Merge builds a new machine from the states and transitions of a and b plus the link transitions
+// connecting them. State hierarchies are kept as they are and the initial state of a becomes the
+// merged initial state, whose Entry actions run as with any new machine. Named states must be
+// unique across both machines.
+func Merge(a, b *HierarchicalStateMachine, link []Transition, opts ...Option) (*HierarchicalStateMachine, error) {
+	names := map[StateName]*State{}
+	for _, sm := range []*HierarchicalStateMachine{a, b} {
+		for _, state := range sm.States() {
+			if state.Name == "" {
+				continue
+			}
+			if known, ok := names[state.Name]; ok && known != state {
+				return nil, fmt.Errorf("duplicate state name %q", state.Name)
+			}
+			names[state.Name] = state
+		}
+	}
+
+	states := make([]State, 0, len(a.states)+len(b.states))
+	states = append(append(states, a.states...), b.states...)
+
+	transitions := make([]Transition, 0, len(a.transitions)+len(b.transitions)+len(link))
+	transitions = append(append(append(transitions, a.transitions...), b.transitions...), link...)
+
+	return NewHierarchicalStateMachine(a.initialState, states, transitions, opts...)
+}
+
+// HandleStateMachine processes state transitions and executes actions accordingly. Calling it
+// from an action while it is already running is handled by the machine's ReentrancyPolicy.
+func HandleStateMachine(sm *HierarchicalStateMachine) {
+	sm.Handle()
+}
+
+// Handle works like HandleStateMachine but returns the error that aborted the call: a failed
+// Precondition, a guard error under GuardErrorAbort, or a failed checked action
+func (sm *HierarchicalStateMachine) Handle() error {
+	return sm.dispatch(trigger{}).Err
+}
+
+// trigger is what a dispatch reacts to: a poll of the Event predicates, or a named event
+type trigger struct {
+	event  string
+	named  bool
+	bubble bool // Also match transitions from ancestors of the current state, nearest first
+}
+
+// Runs a dispatch, then any that were queued by reentrant calls. Reports what the first did and
+// the first error that aborted any of them.
+func (sm *HierarchicalStateMachine) dispatch(tr trigger) DispatchResult {
+	if sm.handling {
+		if sm.reentrancyPolicy == ReentrancyQueue {
+			sm.queued = append(sm.queued, tr)
+			return DispatchResult{Deferred: true}
+		}
+		panic("hierarchicalStateMachine: dispatch called reentrantly while a transition is in progress")
+	}
+
+	if sm.IsLocked() {
+		sm.lastOutcome = Locked
+		return DispatchResult{From: sm.CurrentState, Err: ErrMachineLocked}
+	}
+
+	sm.handling = true
+	defer func() { sm.handling = false }()
+	sm.guardTrace = sm.guardTrace[:0]
+
+	// Parsed machines enter their initial state here, once the caller has added its actions
+	if sm.unentered {
+		sm.unentered = false
+		sm.routingPanics(func() {
+			next := sm.enterFromCommonAncestor(sm.CurrentState, nil, EntryInitial)
+			sm.mu.Lock()
+			sm.CurrentState = next
+			sm.enteredAt = sm.clock.Now()
+			sm.mu.Unlock()
+		})
+	}
+
+	result := DispatchResult{From: sm.CurrentState}
+	start := sm.rtcStart()
+	result.Transition, result.Err = sm.process(tr)
+	if result.Transition != nil {
+		result.Fired = true
+		result.To = sm.CurrentState
+	}
+	if sm.rolledBack(result.Err, start) {
+		return DispatchResult{From: result.From, Err: result.Err}
+	}
+
+	// Coalesced observers may dispatch again, so the queue is drained until the machine settles
+	from := result.From
+	autoCompletes := 0
+	for {
+		for len(sm.queued) > 0 {
+			// Locking from an action also drops the work it queued
+			if sm.IsLocked() {
+				sm.queued = sm.queued[:0]
+				sm.lastOutcome = Locked
+				break
+			}
+			next := sm.queued[0]
+			sm.queued = sm.queued[1:]
+			// Bounded like the OnEntry chain, since a composite leaving and re-entering itself on
+			// the event would post it forever
+			if next.bubble {
+				if autoCompletes++; autoCompletes > MaxStates {
+					sm.queued = sm.queued[:0]
+					if result.Err == nil {
+						result.Err = fmt.Errorf("auto-complete event %q posted more than %d times in one dispatch", next.event, MaxStates)
+					}
+					break
+				}
+			}
+			if _, err := sm.process(next); result.Err == nil {
+				result.Err = err
+			}
+			if sm.rolledBack(result.Err, start) {
+				return DispatchResult{From: result.From, Err: result.Err}
+			}
+		}
+		if !sm.changedSinceSettle {
+			break
+		}
+		sm.changedSinceSettle = false
+		sm.notifyObservers(from, sm.CurrentState)
+		from = sm.CurrentState
+	}
+	return result
+}
+
+// dispatchStart is what WithTransactionalRTC returns the machine to when a dispatch fails
+type dispatchStart struct {
+	state     *State
+	enteredAt time.Time
+	stats     DispatchStats
+}
+
+// firedTransition is a transition fired by the current dispatch and the debounce time it replaced
+type firedTransition struct {
+	transition *Transition
+	lastFired  time.Time
+	debounced  bool // The transition had fired before, so lastFired is restored rather than deleted
+}
+
+// Returns where the dispatch starts from, for rolledBack
+func (sm *HierarchicalStateMachine) rtcStart() dispatchStart {
+	if !sm.transactionalRTC {
+		return dispatchStart{}
+	}
+	sm.rtcFired = sm.rtcFired[:0]
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return dispatchStart{state: sm.CurrentState, enteredAt: sm.enteredAt, stats: sm.dispatchStats}
+}
+
+// Under WithTransactionalRTC, returns the machine to the state, entry time, transition counts,
+// dispatch stats and debounce times it had when the dispatch started after a failed checked
+// action, dropping the queued dispatches, and reports whether it did
+func (sm *HierarchicalStateMachine) rolledBack(err error, start dispatchStart) bool {
+	if !sm.transactionalRTC || err == nil {
+		return false
+	}
+	var failure *actionError
+	if !errors.As(err, &failure) {
+		return false
+	}
+	sm.queued = sm.queued[:0]
+	from, state := sm.CurrentState, start.state
+	sm.mu.Lock()
+	sm.CurrentState = state
+	sm.enteredAt = start.enteredAt
+	sm.dispatchStats = start.stats
+	for _, fired := range sm.rtcFired {
+		sm.transitionCounts[fired.transition]--
+	}
+	sm.mu.Unlock()
+	for i := len(sm.rtcFired) - 1; i >= 0; i-- {
+		fired := sm.rtcFired[i]
+		if fired.debounced {
+			sm.lastFired[fired.transition] = fired.lastFired
+		} else {
+			delete(sm.lastFired, fired.transition)
+		}
+	}
+	sm.rtcFired = sm.rtcFired[:0]
+	// Coalesced observers were not told about the abandoned transitions yet
+	if sm.coalesceObservers {
+		sm.changedSinceSettle = false
+	} else if from != state {
+		sm.notifyObservers(from, state)
+	}
+	return true
+}
+
+// actionError unwinds a transition after one of its CheckedActions failed
+type actionError struct {
+	transition *Transition
+	err        error
+}
+
+func (e *actionError) Error() string {
+	return fmt.Sprintf("action on transition from %q to %q: %v", stateName(e.transition.CurrentState), stateName(e.transition.NextState), e.err)
+}
+
+func (e *actionError) Unwrap() error {
+	return e.err
+}
+
+// Runs the transition's CheckedActions like any other action, unwinding to process at the first
+// error
+func (sm *HierarchicalStateMachine) runCheckedActions(transition *Transition) {
+	for _, action := range transition.CheckedActions {
+		action := action
+		var err error
+		sm.execute(PhaseTransition, transition.CurrentState, func() { err = action() })
+		if err != nil {
+			panic(&actionError{transition: transition, err: err})
+		}
+	}
+}
+
+// Polls run the hooks and Handle actions; named events only evaluate transitions
+func (sm *HierarchicalStateMachine) process(tr trigger) (fired *Transition, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if failure, ok := v.(*actionError); ok {
+				sm.lastOutcome = ActionFailed
+				fired, err = nil, failure
+				return
+			}
+			sm.routePanic(v)
+			fired, err = nil, nil
+		}
+	}()
+
+	for _, precondition := range sm.preconditions {
+		if err := precondition(); err != nil {
+			sm.lastOutcome = PreconditionFailed
+			return nil, fmt.Errorf("precondition failed: %w", err)
+		}
+	}
+
+	if !tr.named && sm.preHandle != nil {
+		sm.preHandle(sm.CurrentState)
+	}
+
+	if sm.deferredExecution {
+		sm.buffering = true
+		defer func() { sm.buffering = false }()
+	}
+
+	// Execute all handlers in current state hierarchy
+	if !tr.named {
+		sm.executeHandleActions(sm.CurrentState)
+		if handleConsumed(sm.CurrentState) {
+			sm.lastOutcome = Consumed
+			if sm.postHandle != nil {
+				sm.postHandle(sm.CurrentState, nil)
+			}
+			return nil, nil
+		}
+	}
+
+	// Events outside the current state's vocabulary are rejected without scanning transitions
+	if tr.named && !tr.bubble && !accepts(sm.CurrentState, tr.event) {
+		sm.lastOutcome = EventNotAccepted
+		sm.countOutcome(tr, EventNotAccepted)
+		sm.unhandled(tr)
+		return nil, nil
+	}
+
+	var outcome HandleOutcome
+	fired, outcome, err = sm.selectTransition(tr)
+	if err != nil && sm.guardErrorPolicy == GuardErrorRoute && !errors.Is(err, ErrAsyncGuardOutsideRun) {
+		sm.enterErrorState(false)
+		err = nil
+	}
+
+	// Vetoes run before anything has exited, so aborting needs no rollback
+	if fired != nil && !allPredicatesPass(fired.Vetoes) {
+		fired, outcome = nil, Vetoed
+	}
+	if fired != nil && fired.TargetPrecondition != nil && !fired.TargetPrecondition() {
+		fired, outcome = nil, TargetNotReady
+	}
+	if fired != nil && sm.beforeTransition != nil && !sm.beforeTransition(fired) {
+		fired, outcome = nil, Cancelled
+	}
+
+	sm.lastOutcome = outcome
+	sm.countOutcome(tr, outcome)
+	switch outcome {
+	case NoMatchingEvent:
+		sm.unhandled(tr)
+	case GuardBlocked:
+		sm.emit(LifecycleEvent{Kind: LifecycleGuardBlocked, State: sm.CurrentState, Event: tr.event})
+		for _, blocked := range append([]*Transition(nil), sm.blocked...) {
+			sm.executeActions(PhaseTransition, blocked.CurrentState, blocked.ElseActions)
+		}
+	}
+	if fired != nil {
+		sm.fire(fired)
+		for i := 0; i < MaxStates; i++ {
+			next := sm.onEntryTransition()
+			if next == nil {
+				break
+			}
+			sm.fire(next)
+		}
+		sm.postAutoComplete()
+	}
+
+	if !tr.named && sm.postHandle != nil {
+		sm.postHandle(sm.CurrentState, fired)
+	}
+	return fired, err
+}
+
+// ErrMachineLocked is returned by dispatches rejected because the machine is locked
+var ErrMachineLocked = errors.New("machine locked")
+
+// Lock makes every HandleStateMachine, SendEvent and Dispatch call a no-op until Unlock, for
+// inspection or shutdown. Unlike WithDeferredExecution nothing is buffered: rejected calls are
+// lost, report the Locked outcome and return ErrMachineLocked. Replay, DryReplay and
+// ResumeFromCheckpoint return ErrMachineLocked without changing anything. Calls queued by the dispatch in
+// progress, such as reentrant ones or WithAutoComplete events, are dropped too. It is distinct
+// from the mutex guarding the metrics and safe to call from any goroutine.
+func (sm *HierarchicalStateMachine) Lock() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.locked = true
+}
+
+// Unlock lets the machine handle calls again after Lock
+func (sm *HierarchicalStateMachine) Unlock() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.locked = false
+}
+
+// IsLocked reports whether the machine is locked with Lock
+func (sm *HierarchicalStateMachine) IsLocked() bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.locked
+}
+
+// Returns the transition to fire from the current state, or nil and the reason none was found
+// Bubbling triggers, and named events under PropagationBubbling, fall back to every transition of
+// the ancestors, others only to the FromDescendants ones, nearest ancestor first
+func (sm *HierarchicalStateMachine) selectTransition(tr trigger) (*Transition, HandleOutcome, error) {
+	bubble := tr.bubble || (tr.named && sm.propagation == PropagationBubbling)
+	sm.blocked = sm.blocked[:0]
+	fired, outcome, err := sm.selectFrom(sm.CurrentState, tr, false)
+	source := sm.CurrentState
+	for i := 0; fired == nil && err == nil && source.ParentState != nil && i < MaxStates; i++ {
+		source = source.ParentState
+		var sourceOutcome HandleOutcome
+		fired, sourceOutcome, err = sm.selectFrom(source, tr, !bubble)
+		if err != nil {
+			return nil, sourceOutcome, err
+		}
+		if sourceOutcome == GuardBlocked {
+			outcome = GuardBlocked
+		}
+	}
+	if err != nil {
+		return nil, outcome, err
+	}
+	if fired != nil {
+		return fired, Transitioned, nil
+	}
+	return nil, outcome, nil
+}
+
+// Returns the transition to fire from the source state, or nil and the reason none was found.
+// scoped only considers transitions with FromDescendants.
+func (sm *HierarchicalStateMachine) selectFrom(source *State, tr trigger, scoped bool) (*Transition, HandleOutcome, error) {
+	var selected *Transition
+	outcome := NoMatchingEvent
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if transition.CurrentState != source || transition.OnEntry || (scoped && !transition.FromDescendants) {
+			continue
+		}
+		if sm.debounced(transition) {
+			continue
+		}
+		occurred, passed, err := sm.evaluate(transition, tr)
+		if !occurred {
+			continue
+		}
+		if err != nil && (sm.guardErrorPolicy != GuardErrorSkip || errors.Is(err, ErrAsyncGuardOutsideRun)) {
+			return nil, GuardErrored, err
+		}
+		if !passed {
+			outcome = GuardBlocked
+			if len(transition.ElseActions) > 0 {
+				sm.blocked = append(sm.blocked, transition)
+			}
+			continue
+		}
+		if sm.duplicatePolicy != HighestPriority {
+			return transition, Transitioned, nil
+		}
+		if selected == nil || sm.outranks(transition, selected) {
+			selected = transition
+		}
+	}
+	if selected != nil {
+		return selected, Transitioned, nil
+	}
+	return nil, outcome, nil
+}
+
+// Returns the first OnEntry transition of the current state that can fire, or nil. Guard errors
+// count as failures.
+func (sm *HierarchicalStateMachine) onEntryTransition() *Transition {
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if !transition.OnEntry || transition.CurrentState != sm.CurrentState || !guardsPassed(transition) || !sm.varGuardsPassed(transition) {
+			continue
+		}
+		if passed, err := checkedGuardsPassed(transition, nil); !passed || err != nil {
+			continue
+		}
+		if passed, err := sm.asyncGuardsPassed(transition); !passed || err != nil {
+			continue
+		}
+		if !allPredicatesPass(transition.Vetoes) || (transition.TargetPrecondition != nil && !transition.TargetPrecondition()) {
+			continue
+		}
+		if sm.beforeTransition != nil && !sm.beforeTransition(transition) {
+			continue
+		}
+		return transition
+	}
+	return nil
+}
+
+// Reports whether the transition fired less than its Debounce ago
+func (sm *HierarchicalStateMachine) debounced(transition *Transition) bool {
+	if transition.Debounce <= 0 {
+		return false
+	}
+	fired, ok := sm.lastFired[transition]
+	return ok && sm.clock.Now().Sub(fired) < transition.Debounce
+}
+
+// Reports whether a takes precedence over b under HighestPriority
+func (sm *HierarchicalStateMachine) outranks(a, b *Transition) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return sm.tieBreaker != nil && sm.tieBreaker(a, b)
+}
+
+// Reports whether the transition's event occurred and whether its guards then passed
+func (sm *HierarchicalStateMachine) evaluate(transition *Transition, tr trigger) (occurred, passed bool, err error) {
+	if sm.tracingGuards {
+		return sm.evaluateTraced(transition, tr)
+	}
+	if !triggered(transition, tr) {
+		return false, false, nil
+	}
+	if sm.checkingPurity && !sm.pureGuardsPassed(transition) {
+		return true, false, nil
+	}
+	if !sm.checkingPurity && !guardsPassed(transition) {
+		return true, false, nil
+	}
+	if !sm.varGuardsPassed(transition) {
+		return true, false, nil
+	}
+	passed, err = checkedGuardsPassed(transition, nil)
+	if passed {
+		passed, err = sm.asyncGuardsPassed(transition)
+	}
+	return true, passed, err
+}
+
+// Runs the transition and moves the machine to the state it settles in
+func (sm *HierarchicalStateMachine) fire(transition *Transition) {
+	from, fromEnteredAt := sm.CurrentState, sm.enteredAt
+	next := sm.executeTransitionActions(transition)
+
+	// Recorded once the actions ran, so Discard doesn't revert a transition abandoned midway
+	if sm.deferredExecution {
+		if len(sm.pendingTransitions) == 0 {
+			sm.pendingFrom = from
+			sm.pendingEnteredAt = fromEnteredAt
+		}
+		sm.pendingTransitions = append(sm.pendingTransitions, transition)
+	}
+
+	sm.mu.Lock()
+	sm.CurrentState = next
+	sm.transitionCounts[transition]++
+	sm.enteredAt = sm.clock.Now()
+	sm.mu.Unlock()
+	if sm.transactionalRTC {
+		previous, debounced := sm.lastFired[transition]
+		sm.rtcFired = append(sm.rtcFired, firedTransition{transition: transition, lastFired: previous, debounced: debounced})
+	}
+	if transition.Debounce > 0 {
+		if sm.lastFired == nil {
+			sm.lastFired = map[*Transition]time.Time{}
+		}
+		sm.lastFired[transition] = sm.enteredAt
+	}
+	sm.emit(LifecycleEvent{Kind: LifecycleTransition, State: next, Transition: transition})
+	sm.changed(from, next)
+	if transition.OnComplete != nil {
+		sm.execute(PhaseTransition, transition.CurrentState, transition.OnComplete)
+	}
+}
+
+// Posts the WithAutoComplete event once the OnEntry chain has settled the machine on a leaf it
+// can't leave. It runs once the current dispatch finishes, like a queued reentrant call.
+func (sm *HierarchicalStateMachine) postAutoComplete() {
+	if sm.autoCompleteEvent != "" && !sm.hasOutgoing(sm.CurrentState) && !isParentOfAny(sm.CurrentState, sm.States()) {
+		sm.queued = append(sm.queued, trigger{event: sm.autoCompleteEvent, named: true, bubble: true})
+	}
+}
+
+// Leaves the current state for the error state as if by a transition, without counting it
+func (sm *HierarchicalStateMachine) enterErrorState(skipExit bool) {
+	from := sm.CurrentState
+	route := Transition{CurrentState: from, NextState: sm.errorState, SkipExit: skipExit}
+	next := sm.executeTransitionActions(&route)
+
+	sm.mu.Lock()
+	sm.CurrentState = next
+	sm.enteredAt = sm.clock.Now()
+	sm.mu.Unlock()
+	sm.changed(from, next)
+}
+
+// Flush runs the actions buffered by WithDeferredExecution, committing the transitions computed
+// since the last Flush or Discard
+func (sm *HierarchicalStateMachine) Flush() {
+	actions := sm.pendingActions
+	sm.clearPending()
+
+	defer func() {
+		if v := recover(); v != nil {
+			sm.routePanic(v)
+		}
+	}()
+	for _, action := range actions {
+		sm.run(action)
+	}
+}
+
+// StepAction runs the next action buffered by WithStepMode or WithDeferredExecution and reports
+// whether none are left. The first step commits the buffered transitions, so a later Discard only
+// drops the remaining actions.
+func (sm *HierarchicalStateMachine) StepAction() (done bool) {
+	if len(sm.pendingActions) == 0 {
+		return true
+	}
+	action := sm.pendingActions[0]
+	sm.pendingActions = sm.pendingActions[1:]
+	sm.pendingTransitions = nil
+	sm.pendingFrom = nil
+	sm.pendingVisits = nil
+
+	defer func() {
+		if v := recover(); v != nil {
+			sm.pendingActions = nil
+			sm.routePanic(v)
+			done = true
+		}
+	}()
+	sm.run(action)
+	return len(sm.pendingActions) == 0
+}
+
+// Discard drops the actions buffered by WithDeferredExecution and reverts the state changes of
+// the transitions computed since the last Flush or Discard. Observers, told about those changes
+// as they were computed, are notified of the revert.
+func (sm *HierarchicalStateMachine) Discard() {
+	if len(sm.pendingTransitions) > 0 {
+		from, to := sm.CurrentState, sm.pendingFrom
+		defer func() {
+			if from != to {
+				sm.notifyObservers(from, to)
+			}
+		}()
+		sm.mu.Lock()
+		sm.CurrentState = sm.pendingFrom
+		sm.enteredAt = sm.pendingEnteredAt
+		for _, transition := range sm.pendingTransitions {
+			sm.transitionCounts[transition]--
+		}
+		sm.mu.Unlock()
+	}
+	for _, state := range sm.pendingVisits {
+		delete(sm.visited, state)
+	}
+	sm.clearPending()
+}
+
+func (sm *HierarchicalStateMachine) clearPending() {
+	sm.pendingActions = nil
+	sm.pendingTransitions = nil
+	sm.pendingFrom = nil
+	sm.pendingVisits = nil
+}
+
+// Precondition registers a check run at the start of every HandleStateMachine, SendEvent and
+// Dispatch call, including those made by Run, before the pre-handle hook. If any check fails
+// nothing else runs and Handle, or the Err of the DispatchResult, returns the error.
+func (sm *HierarchicalStateMachine) Precondition(fn func() error) {
+	sm.preconditions = append(sm.preconditions, fn)
+}
+
+// OnFirstEnter registers fn to run the first time the named state is entered over the machine's
+// lifetime, before its Entry actions. States entered before the call, such as the initial
+// hierarchy, count as already entered.
+func (sm *HierarchicalStateMachine) OnFirstEnter(name StateName, fn Action) {
+	if sm.firstEnter == nil {
+		sm.firstEnter = map[StateName][]Action{}
+	}
+	sm.firstEnter[name] = append(sm.firstEnter[name], fn)
+}
+
+// OnRegionEnter registers fn to run when a transition enters the composite from outside, after
+// its Entry actions. Transitions between states inside the composite don't run it. A later call
+// for the same composite replaces fn.
+func (sm *HierarchicalStateMachine) OnRegionEnter(composite *State, fn func()) {
+	if sm.regionEnters == nil {
+		sm.regionEnters = map[*State]Action{}
+	}
+	sm.regionEnters[composite] = fn
 }
 
-type Transition struct {
-	CurrentState *State
-	Event        Predicate
-	Guards       []Predicate
-	Actions      []Action
-	NextState    *State
+// OnRegionExit registers fn to run when a transition leaves the composite entirely, after its
+// Exit actions. Transitions between states inside the composite don't run it. A later call for
+// the same composite replaces fn.
+func (sm *HierarchicalStateMachine) OnRegionExit(composite *State, fn func()) {
+	if sm.regionExits == nil {
+		sm.regionExits = map[*State]Action{}
+	}
+	sm.regionExits[composite] = fn
 }
 
-type HierarchicalStateMachine struct {
-	CurrentState *State
-	states       []State
-	transitions  []Transition
+// Marks the state as entered, running its first-enter actions if it wasn't before. A dry replay
+// runs no actions, so it leaves the state unvisited, and Discard forgets the visits of the
+// transitions it reverts.
+func (sm *HierarchicalStateMachine) visit(state *State) {
+	if sm.visited[state] || sm.dryReplay {
+		return
+	}
+	if sm.visited == nil {
+		sm.visited = map[*State]bool{}
+	}
+	sm.visited[state] = true
+	if sm.buffering {
+		sm.pendingVisits = append(sm.pendingVisits, state)
+	}
+	sm.executeActions(PhaseEntry, state, sm.firstEnter[state.Name])
 }
 
-func NewHierarchicalStateMachine(initialState *State, states []State, transitions []Transition) (*HierarchicalStateMachine, error) {
-	if len(states) > MaxStates {
-		return nil, fmt.Errorf("too many states declared: %d. max allowed is %d", len(states), MaxStates)
+// SetPreHandle registers a hook run at the start of every HandleStateMachine call, before any
+// Handle actions or transitions are evaluated
+func (sm *HierarchicalStateMachine) SetPreHandle(fn func(current *State)) {
+	sm.preHandle = fn
+}
+
+// SetBeforeTransition registers a hook asked about every transition about to fire, once its
+// Vetoes and TargetPrecondition passed but before any Exit, for auditing or authorization applied
+// uniformly. Returning false cancels the transition with nothing run, leaving the machine in its
+// source state and reporting the Cancelled outcome.
+func (sm *HierarchicalStateMachine) SetBeforeTransition(fn func(t *Transition) bool) {
+	sm.beforeTransition = fn
+}
+
+// OnUnhandled registers a hook run when a named event fires no transition because none matched it
+// or the current state's AcceptedEvents rejected it. Events blocked by guards are not unhandled.
+func (sm *HierarchicalStateMachine) OnUnhandled(fn func(current *State, event string)) {
+	sm.onUnhandled = fn
+}
+
+// Reports the trigger as unhandled to the lifecycle stream and, for named events, the hook
+func (sm *HierarchicalStateMachine) unhandled(tr trigger) {
+	sm.emit(LifecycleEvent{Kind: LifecycleUnhandled, State: sm.CurrentState, Event: tr.event})
+	if tr.named && sm.onUnhandled != nil {
+		sm.onUnhandled(sm.CurrentState, tr.event)
 	}
-	sm := &HierarchicalStateMachine{
-		CurrentState: initialState,
-		states:       states,
-		transitions:  transitions,
+}
+
+// Reports whether the state's AcceptedEvents allow the event
+func accepts(state *State, event string) bool {
+	if len(state.AcceptedEvents) == 0 {
+		return true
+	}
+	for _, accepted := range state.AcceptedEvents {
+		if accepted == event {
+			return true
+		}
 	}
+	return false
+}
 
-	// Execute all entry actions in current state hierarchy
-	executeActionsInHierarchy(sm.CurrentState, func(s *State) []Action { return s.Entry })
+// SetPostHandle registers a hook run at the end of every HandleStateMachine call. fired is the
+// transition taken, or nil if none fired.
+func (sm *HierarchicalStateMachine) SetPostHandle(fn func(current *State, fired *Transition)) {
+	sm.postHandle = fn
+}
 
-	return sm, nil
+// SetContext stores shared dependencies for actions to reach through the machine instead of globals
+func (sm *HierarchicalStateMachine) SetContext(ctx interface{}) {
+	sm.userContext = ctx
 }
 
-// HandleStateMachine processes state transitions and executes actions accordingly
-func HandleStateMachine(sm *HierarchicalStateMachine) {
-	// Execute all handlers in current state hierarchy
-	executeActionsInHierarchy(sm.CurrentState, func(s *State) []Action { return s.Handle })
+// Context returns the value stored with SetContext
+func (sm *HierarchicalStateMachine) Context() interface{} {
+	return sm.userContext
+}
 
-	for _, transition := range sm.transitions {
-		if sm.CurrentState == transition.CurrentState {
-			if !transition.Event() {
-				continue
-			}
+// SetVar stores an extended state variable for actions to update and guards to read
+func (sm *HierarchicalStateMachine) SetVar(key string, v interface{}) {
+	if sm.vars == nil {
+		sm.vars = map[string]interface{}{}
+	}
+	sm.vars[key] = v
+}
 
-			guardsPassed := true
-			for _, guard := range transition.Guards {
-				if !guard() {
-					guardsPassed = false
-					break
-				}
+// GetVar returns the extended state variable stored under key and whether it was set
+func (sm *HierarchicalStateMachine) GetVar(key string) (interface{}, bool) {
+	v, ok := sm.vars[key]
+	return v, ok
+}
+
+// LastHandleOutcome reports what the most recent HandleStateMachine or SendEvent call did
+func (sm *HierarchicalStateMachine) LastHandleOutcome() HandleOutcome {
+	return sm.lastOutcome
+}
+
+// MetricsSnapshot is a consistent view of the machine's metrics
+type MetricsSnapshot struct {
+	TransitionCounts map[*Transition]int
+	CurrentState     *State
+	TimeInState      time.Duration
+	States           []*State // The states known to the machine, as States returns them
+}
+
+// DispatchStats counts what dispatches that reached transition selection did, for alerting on
+// dropped events
+type DispatchStats struct {
+	Transitioned int // A transition fired
+	Ignored      int // No transition matched a named event, or the current state didn't accept it
+	GuardBlocked int // Transitions matched but their guards failed
+}
+
+// DispatchStats returns the counts since construction or the last Replay. It is safe to call
+// while another goroutine handles the machine.
+func (sm *HierarchicalStateMachine) DispatchStats() DispatchStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.dispatchStats
+}
+
+// Polls matching nothing are the usual idle tick, so only named events count as ignored
+func (sm *HierarchicalStateMachine) countOutcome(tr trigger, outcome HandleOutcome) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	switch outcome {
+	case Transitioned:
+		sm.dispatchStats.Transitioned++
+	case NoMatchingEvent, EventNotAccepted:
+		if tr.named {
+			sm.dispatchStats.Ignored++
+		}
+	case GuardBlocked:
+		sm.dispatchStats.GuardBlocked++
+	}
+}
+
+// TransitionCounts returns how many times each transition has fired. The map is a copy and it
+// is safe to call while another goroutine handles the machine.
+func (sm *HierarchicalStateMachine) TransitionCounts() map[*Transition]int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.copyTransitionCounts()
+}
+
+func (sm *HierarchicalStateMachine) copyTransitionCounts() map[*Transition]int {
+	counts := make(map[*Transition]int, len(sm.transitionCounts))
+	for transition, count := range sm.transitionCounts {
+		counts[transition] = count
+	}
+	return counts
+}
+
+// TimeInState returns how long the machine has been in its current state. It is safe to call
+// while another goroutine handles the machine.
+func (sm *HierarchicalStateMachine) TimeInState() time.Duration {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.clock.Now().Sub(sm.enteredAt)
+}
+
+// MetricsSnapshot returns the transition counts, current state, time in state and known states
+// taken together, so they agree with each other even while another goroutine handles the machine
+func (sm *HierarchicalStateMachine) MetricsSnapshot() MetricsSnapshot {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return MetricsSnapshot{
+		TransitionCounts: sm.copyTransitionCounts(),
+		CurrentState:     sm.CurrentState,
+		TimeInState:      sm.clock.Now().Sub(sm.enteredAt),
+		States:           sm.knownStates(true),
+	}
+}
+
+// InitialState returns the state passed to the constructor, before following its initial
+// descendants
+func (sm *HierarchicalStateMachine) InitialState() *State {
+	return sm.initialState
+}
+
+// States returns every state known to the machine: the initial and current states, the transition
+// endpoints, their ancestors and initial descendants, in discovery order without duplicates
+func (sm *HierarchicalStateMachine) States() []*State {
+	return sm.knownStates(true)
+}
+
+// Counts returns how many states and transitions were passed to the constructor, to confirm a
+// machine loaded fully. Transitions with CurrentStates count once.
+func (sm *HierarchicalStateMachine) Counts() (states, transitions int) {
+	return len(sm.states), sm.declaredTransitions
+}
+
+// Returns the states reachable through the machine's definition, and through the current state
+// when includeCurrent is set
+func (sm *HierarchicalStateMachine) knownStates(includeCurrent bool) []*State {
+	var states []*State
+	var add func(state *State)
+	add = func(state *State) {
+		if state == nil {
+			return
+		}
+		for _, known := range states {
+			if known == state {
+				return
 			}
-			if !guardsPassed {
-				continue
+		}
+		states = append(states, state)
+		add(state.ParentState)
+		add(state.Initial)
+		for _, choice := range state.InitialChoices {
+			add(choice.State)
+		}
+	}
+
+	add(sm.initialState)
+	if includeCurrent {
+		add(sm.CurrentState)
+	}
+	for i := range sm.transitions {
+		add(sm.transitions[i].CurrentState)
+		add(sm.transitions[i].NextState)
+	}
+	add(sm.errorState)
+	return states
+}
+
+// SelfCheck verifies the runtime invariants of the current state: it must be known to the machine
+// through its definition, its ParentState chain must be acyclic and made of known states, and it
+// must be a leaf rather than a state with an Initial. It is cheap enough to call periodically to
+// catch misuse such as assigning CurrentState directly.
+func (sm *HierarchicalStateMachine) SelfCheck() error {
+	current := sm.CurrentState
+	if current == nil {
+		return fmt.Errorf("current state is nil")
+	}
+	known := sm.knownStates(false)
+	if !containsState(known, current) {
+		return fmt.Errorf("current state %q is not registered with the machine", current.Name)
+	}
+	if current.Depth() >= MaxStates {
+		return fmt.Errorf("current state %q has a cyclic or too deep ParentState chain", current.Name)
+	}
+	for parent := current.ParentState; parent != nil; parent = parent.ParentState {
+		if !containsState(known, parent) {
+			return fmt.Errorf("ancestor %q of current state %q is not registered with the machine", parent.Name, current.Name)
+		}
+	}
+	if current.Initial != nil {
+		return fmt.Errorf("current state %q has an initial state, so the machine is not resting on a leaf", current.Name)
+	}
+	return nil
+}
+
+// Reparent moves child, with its descendants, under newParent, or to the root when newParent is
+// nil. Both must be known to the machine, the move must not create a cycle or leave an initial
+// state outside its composite, and the machine must not currently be in child's subtree.
+func (sm *HierarchicalStateMachine) Reparent(child, newParent *State) error {
+	states := sm.States()
+	if !containsState(states, child) || (newParent != nil && !containsState(states, newParent)) {
+		return fmt.Errorf("cannot reparent states unknown to the machine")
+	}
+	if newParent == child || (newParent != nil && isDescendant(newParent, child)) {
+		return fmt.Errorf("reparenting %q under %q would create a cycle", child.Name, newParent.Name)
+	}
+	if sm.CurrentState == child || isDescendant(sm.CurrentState, child) {
+		return fmt.Errorf("cannot reparent %q while the machine is in its subtree", child.Name)
+	}
+
+	oldParent := child.ParentState
+	child.ParentState = newParent
+	for _, state := range states {
+		if err := validateInitial(state); err != nil {
+			child.ParentState = oldParent
+			return fmt.Errorf("cannot reparent %q: %v", child.Name, err)
+		}
+	}
+	return nil
+}
+
+// CloneSubtree deep-copies root and all its descendants known to the machine, for templating
+// repeated regions. States only link to their parents, so the descendants are found among the
+// machine's states. The copies get new pointers and their own copies of the action and callback
+// slices, with ParentState, Initial and InitialChoices pointing at the copies. The new root has no
+// parent, so set its ParentState to place it. Names are copied unchanged. Transitions reference
+// states by pointer and are not copied, so declare them for the copies. Returns the new root and
+// every copy, root first, for registration in a new machine.
+func (sm *HierarchicalStateMachine) CloneSubtree(root *State) (*State, []*State) {
+	originals := []*State{root}
+	for _, state := range sm.States() {
+		if isDescendant(state, root) {
+			originals = append(originals, state)
+		}
+	}
+
+	clones := make(map[*State]*State, len(originals))
+	copies := make([]*State, len(originals))
+	for i, original := range originals {
+		clone := *original
+		clone.Entry = append([]Action(nil), original.Entry...)
+		clone.Exit = append([]Action(nil), original.Exit...)
+		clone.Handle = append([]Action(nil), original.Handle...)
+		clone.HandleConsumers = append([]func() bool(nil), original.HandleConsumers...)
+		clone.EntryWithReason = append(([]func(EntryReason))(nil), original.EntryWithReason...)
+		clone.AcceptedEvents = append([]string(nil), original.AcceptedEvents...)
+		clone.InitialChoices = append([]InitialChoice(nil), original.InitialChoices...)
+		copies[i] = &clone
+		clones[original] = &clone
+	}
+
+	remap := func(state *State) *State {
+		if clone, ok := clones[state]; ok {
+			return clone
+		}
+		return state
+	}
+	for _, clone := range copies {
+		clone.ParentState = remap(clone.ParentState)
+		clone.Initial = remap(clone.Initial)
+		for i := range clone.InitialChoices {
+			clone.InitialChoices[i].State = remap(clone.InitialChoices[i].State)
+		}
+	}
+	copies[0].ParentState = nil
+	return copies[0], copies
+}
+
+func containsState(states []*State, state *State) bool {
+	for _, known := range states {
+		if known == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Two transitions from the same state could both be eligible when they share an event name, or
+// when both are unnamed and have no Event. Event predicates are opaque, so other unnamed
+// transitions can't be compared.
+func (sm *HierarchicalStateMachine) checkDuplicates() error {
+	for i := range sm.transitions {
+		for j := i + 1; j < len(sm.transitions); j++ {
+			a, b := &sm.transitions[i], &sm.transitions[j]
+			if a.CurrentState == b.CurrentState && sameTrigger(a, b) {
+				return fmt.Errorf("transitions %d and %d from state %q could both be eligible", i, j, stateName(a.CurrentState))
 			}
+		}
+	}
+	return nil
+}
 
-			executeTransitionActions(transition)
-			sm.CurrentState = transition.NextState
-			break
+func sameTrigger(a, b *Transition) bool {
+	if a.EventName != "" || b.EventName != "" {
+		return a.EventName == b.EventName
+	}
+	return a.Event == nil && b.Event == nil
+}
+
+func stateName(state *State) StateName {
+	if state == nil {
+		return ""
+	}
+	return state.Name
+}
+
+// Named events match by name. Polls evaluate the Event predicate, where a nil Event is always
+// eligible unless the transition is named, leaving the decision to the guards.
+func triggered(transition *Transition, tr trigger) bool {
+	if tr.named {
+		return transition.EventName == tr.event
+	}
+	if transition.Event == nil {
+		return transition.EventName == ""
+	}
+	return transition.Event()
+}
+
+// The combined result of the guards, inverted by InvertGuards
+func guardsPassed(transition *Transition) bool {
+	return combinedGuardsPass(transition) != transition.InvertGuards
+}
+
+// Guards must all pass and, when GuardGroups is set, at least one group must fully pass
+func combinedGuardsPass(transition *Transition) bool {
+	if !allPredicatesPass(transition.Guards) {
+		return false
+	}
+	if len(transition.GuardGroups) == 0 {
+		return true
+	}
+	for _, group := range transition.GuardGroups {
+		if allPredicatesPass(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// A failing or erroring guard stops the evaluation, so later guards are not run. Each result is
+// appended to results when it is set.
+func checkedGuardsPassed(transition *Transition, results *[]bool) (bool, error) {
+	for _, guard := range transition.CheckedGuards {
+		passed, err := guard()
+		if results != nil {
+			*results = append(*results, passed && err == nil)
+		}
+		if err != nil {
+			return false, fmt.Errorf("guard on transition from %q to %q: %w", stateName(transition.CurrentState), stateName(transition.NextState), err)
+		}
+		if !passed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func allPredicatesPass(predicates []Predicate) bool {
+	for _, predicate := range predicates {
+		if !predicate() {
+			return false
 		}
 	}
+	return true
 }
 
-func executeActions(actions []Action) {
+func (sm *HierarchicalStateMachine) executeActions(phase Phase, state *State, actions []Action) {
 	for _, action := range actions {
-		action()
+		sm.execute(phase, state, action)
+	}
+}
+
+// Every action goes through here, so deferred execution can buffer it instead of running it. The
+// phase's PanicPolicy and the action log are applied before buffering, so they also hold when
+// Flush runs the action. state is the state the action belongs to, the source for transitions.
+func (sm *HierarchicalStateMachine) execute(phase Phase, state *State, action Action) {
+	if sm.dryReplay {
+		return
+	}
+	action = sm.isolate(phase, sm.logged(phase, state, action))
+	if sm.buffering {
+		sm.pendingActions = append(sm.pendingActions, action)
+		return
+	}
+	sm.run(action)
+}
+
+// Like executeActions for the Entry actions of a ParallelEntry state, each run on its own
+// goroutine with its own PanicPolicy and action log entry. The group is buffered as a whole, and a
+// panic that escapes an action is raised again once all of them have returned.
+func (sm *HierarchicalStateMachine) executeParallel(state *State) {
+	if sm.dryReplay {
+		return
+	}
+	actions := make([]Action, len(state.Entry))
+	for i, action := range state.Entry {
+		actions[i] = sm.isolate(PhaseEntry, sm.logged(PhaseEntry, state, action))
+	}
+	group := func() {
+		var wg sync.WaitGroup
+		panics := make([]interface{}, len(actions))
+		for i, action := range actions {
+			wg.Add(1)
+			go func(i int, action Action) {
+				defer wg.Done()
+				defer func() { panics[i] = recover() }()
+				sm.run(action)
+			}(i, action)
+		}
+		wg.Wait()
+		for _, v := range panics {
+			if v != nil {
+				panic(v)
+			}
+		}
+	}
+	if sm.buffering {
+		sm.pendingActions = append(sm.pendingActions, group)
+		return
+	}
+	group()
+}
+
+// Runs the action through the executor set by WithExecutor, or inline without one
+func (sm *HierarchicalStateMachine) run(action Action) {
+	if sm.executor != nil {
+		sm.executor.Run(action)
+		return
 	}
+	action()
 }
 
-// Parent actions are executed first
-func executeActionsInHierarchy(state *State, actions func(s *State) []Action) {
+// Parent actions are executed first, up to the first state that skips its ancestors
+func (sm *HierarchicalStateMachine) executeHandleActions(state *State) {
 	if state == nil {
 		return
 	}
-	executeActionsInHierarchy(state.ParentState, actions)
-	executeActions(actions(state))
+	if !state.SkipAncestorHandle {
+		sm.executeHandleActions(state.ParentState)
+	}
+	sm.executeActions(PhaseHandle, state, state.Handle)
+}
+
+// Consumers follow the same hierarchy order as Handle actions and stop at the first that consumes
+func handleConsumed(state *State) bool {
+	if state == nil {
+		return false
+	}
+	if !state.SkipAncestorHandle && handleConsumed(state.ParentState) {
+		return true
+	}
+	for _, consumer := range state.HandleConsumers {
+		if consumer() {
+			return true
+		}
+	}
+	return false
 }
 
-func executeTransitionActions(transition Transition) {
+// Returns the state the machine settles in
+func (sm *HierarchicalStateMachine) executeTransitionActions(transition *Transition) *State {
+	// Exiting starts from the current state, which is below the source when an ancestor's
+	// transition fires
 	commonAncestor := findCommonAncestor(transition.CurrentState, transition.NextState)
-	exitToCommonAncestor(transition.CurrentState, commonAncestor)
-	executeActions(transition.Actions)
-	enterFromCommonAncestor(transition.NextState, commonAncestor)
+	sm.pathActions = transition.PathActions
+	defer func() { sm.pathActions = nil }()
+	crossed := 0
+	if !transition.SkipExit {
+		crossed = crossedLevels(sm.CurrentState, commonAncestor)
+		sm.exitToCommonAncestor(sm.CurrentState, commonAncestor)
+	} else {
+		sm.stopActivitiesToCommonAncestor(sm.CurrentState, commonAncestor)
+	}
+	sm.executeActions(PhaseTransition, transition.CurrentState, transition.Actions)
+	for _, action := range transition.ActionsWithDepth {
+		// Copied so the closure doesn't move crossed to the heap on every transition
+		action, crossed := action, crossed
+		sm.execute(PhaseTransition, transition.CurrentState, func() { action(crossed) })
+	}
+	sm.runCheckedActions(transition)
+	if transition.SkipEntry {
+		return transition.NextState
+	}
+	return sm.enterFromCommonAncestor(transition.NextState, commonAncestor, EntryNormal)
+}
+
+// Returns how many ancestors of the state are exited on the way up to the common ancestor
+func crossedLevels(state, commonAncestor *State) int {
+	exited := 0
+	for ; state != commonAncestor && state != nil && exited <= MaxStates; state = state.ParentState {
+		exited++
+	}
+	if exited == 0 {
+		return 0
+	}
+	return exited - 1
 }
 
 // Returns the deepest common ancestor of the two states
@@ -121,15 +1665,187 @@ func findCommonAncestor(state1, state2 *State) *State {
 }
 
 // Executes exit actions up to the common ancestor
-func exitToCommonAncestor(state *State, commonAncestor *State) {
+func (sm *HierarchicalStateMachine) exitToCommonAncestor(state *State, commonAncestor *State) {
 	for state != commonAncestor {
-		executeActions(state.Exit)
+		sm.stopActivity(state)
+		if state.ReverseExitOrder {
+			for i := len(state.Exit) - 1; i >= 0; i-- {
+				sm.execute(PhaseExit, state, state.Exit[i])
+			}
+		} else {
+			sm.executeActions(PhaseExit, state, state.Exit)
+		}
+		sm.executeActions(PhaseExit, state, sm.pathActions[state])
+		if action, ok := sm.regionExits[state]; ok {
+			sm.execute(PhaseExit, state, action)
+		}
+		sm.emit(LifecycleEvent{Kind: LifecycleExit, State: state})
+		state = state.ParentState
+	}
+}
+
+// Stops the activities of the states left without running their Exit actions
+func (sm *HierarchicalStateMachine) stopActivitiesToCommonAncestor(state *State, commonAncestor *State) {
+	for depth := 0; state != commonAncestor && state != nil && depth < MaxStates; depth++ {
+		sm.stopActivity(state)
 		state = state.ParentState
 	}
 }
 
-// Executes entry actions from the common ancestor
-func enterFromCommonAncestor(state *State, commonAncestor *State) {
+// Executes entry actions from the common ancestor, then follows initial descendants.
+// Returns the state the machine settles in.
+func (sm *HierarchicalStateMachine) enterFromCommonAncestor(state *State, commonAncestor *State, reason EntryReason) *State {
+	sm.enterPath(state, commonAncestor, reason)
+	for i := 0; i < MaxStates; i++ {
+		child := initialDescendant(state)
+		if child == nil {
+			break
+		}
+		sm.enterPath(child, state, EntryInitial)
+		state = child
+	}
+	return state
+}
+
+// Returns the descendant to enter when the state is targeted, or nil if it has none
+func initialDescendant(state *State) *State {
+	for _, choice := range state.InitialChoices {
+		if choice.Guard == nil || choice.Guard() {
+			return choice.State
+		}
+	}
+	return state.Initial
+}
+
+// Initial descendants must be real descendants, and choices need Initial as their default
+func validateInitial(state *State) error {
+	if len(state.InitialChoices) > 0 && state.Initial == nil {
+		return fmt.Errorf("state %q has initial choices but no default Initial state", state.Name)
+	}
+	if state.Initial != nil && !isDescendant(state.Initial, state) {
+		return fmt.Errorf("initial state %q of %q is not one of its descendants", state.Initial.Name, state.Name)
+	}
+	for _, choice := range state.InitialChoices {
+		if choice.State == nil || !isDescendant(choice.State, state) {
+			return fmt.Errorf("initial choice of %q is not one of its descendants", state.Name)
+		}
+	}
+	return nil
+}
+
+// A nil Event is allowed and always occurs, but nil entries in the lists would panic when run
+func validateTransitionFuncs(transition *Transition) error {
+	from, to := stateName(transition.CurrentState), stateName(transition.NextState)
+	for _, guard := range transition.Guards {
+		if guard == nil {
+			return fmt.Errorf("transition from %q to %q has a nil guard", from, to)
+		}
+	}
+	for _, group := range transition.GuardGroups {
+		for _, guard := range group {
+			if guard == nil {
+				return fmt.Errorf("transition from %q to %q has a nil guard in a guard group", from, to)
+			}
+		}
+	}
+	for _, guard := range transition.CheckedGuards {
+		if guard == nil {
+			return fmt.Errorf("transition from %q to %q has a nil checked guard", from, to)
+		}
+	}
+	for _, guard := range transition.AsyncGuards {
+		if guard == nil {
+			return fmt.Errorf("transition from %q to %q has a nil async guard", from, to)
+		}
+	}
+	for _, veto := range transition.Vetoes {
+		if veto == nil {
+			return fmt.Errorf("transition from %q to %q has a nil veto", from, to)
+		}
+	}
+	for _, action := range transition.Actions {
+		if action == nil {
+			return fmt.Errorf("transition from %q to %q has a nil action", from, to)
+		}
+	}
+	for _, action := range transition.ActionsWithDepth {
+		if action == nil {
+			return fmt.Errorf("transition from %q to %q has a nil depth action", from, to)
+		}
+	}
+	for _, action := range transition.ElseActions {
+		if action == nil {
+			return fmt.Errorf("transition from %q to %q has a nil else action", from, to)
+		}
+	}
+	for _, action := range transition.CheckedActions {
+		if action == nil {
+			return fmt.Errorf("transition from %q to %q has a nil checked action", from, to)
+		}
+	}
+	for _, actions := range transition.PathActions {
+		for _, action := range actions {
+			if action == nil {
+				return fmt.Errorf("transition from %q to %q has a nil path action", from, to)
+			}
+		}
+	}
+	return nil
+}
+
+func validateStateFuncs(state *State) error {
+	for _, actions := range [][]Action{state.Entry, state.Exit, state.Handle} {
+		for _, action := range actions {
+			if action == nil {
+				return fmt.Errorf("state %q has a nil action", state.Name)
+			}
+		}
+	}
+	for _, consumer := range state.HandleConsumers {
+		if consumer == nil {
+			return fmt.Errorf("state %q has a nil handle consumer", state.Name)
+		}
+	}
+	for _, entry := range state.EntryWithReason {
+		if entry == nil {
+			return fmt.Errorf("state %q has a nil entry callback", state.Name)
+		}
+	}
+	return nil
+}
+
+// Reports whether the transition can fire while the machine is in the state, on any trigger
+func leavesFrom(transition *Transition, state *State) bool {
+	return transition.CurrentState == state || (transition.FromDescendants && isDescendant(state, transition.CurrentState))
+}
+
+// Like leavesFrom, but also counts the ancestor transitions named events reach under
+// PropagationBubbling
+func (sm *HierarchicalStateMachine) canLeave(transition *Transition, state *State) bool {
+	if leavesFrom(transition, state) {
+		return true
+	}
+	return sm.propagation == PropagationBubbling && transition.EventName != "" && !transition.OnEntry && isDescendant(state, transition.CurrentState)
+}
+
+// Like canLeave, but only for the transitions a dispatch considers once the machine has settled in
+// the state, which leaves out OnEntry transitions
+func (sm *HierarchicalStateMachine) leavesAtRest(transition *Transition, state *State) bool {
+	return !transition.OnEntry && sm.canLeave(transition, state)
+}
+
+// Reports whether state is a strict descendant of ancestor
+func isDescendant(state, ancestor *State) bool {
+	for parent, depth := state.ParentState, 0; parent != nil && depth < MaxStates; parent, depth = parent.ParentState, depth+1 {
+		if parent == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// Executes entry actions from (not including) the common ancestor down to the state
+func (sm *HierarchicalStateMachine) enterPath(state *State, commonAncestor *State, reason EntryReason) {
 
 	var stack [MaxStates]*State
 	stackCount := 0
@@ -141,6 +1857,28 @@ func enterFromCommonAncestor(state *State, commonAncestor *State) {
 	}
 
 	for i := stackCount - 1; i >= 0; i-- {
-		executeActions(stack[i].Entry)
+		sm.executeEntryActions(stack[i], reason)
+	}
+}
+
+// Executes the entry actions of a single state, concurrently if ParallelEntry is set
+func (sm *HierarchicalStateMachine) executeEntryActions(state *State, reason EntryReason) {
+	sm.visit(state)
+
+	if !state.ParallelEntry {
+		sm.executeActions(PhaseEntry, state, state.Entry)
+	} else {
+		sm.executeParallel(state)
+	}
+	sm.executeActions(PhaseEntry, state, sm.pathActions[state])
+
+	for _, entry := range state.EntryWithReason {
+		entry := entry
+		sm.execute(PhaseEntry, state, func() { entry(reason) })
+	}
+	if fn, ok := sm.regionEnters[state]; ok {
+		sm.execute(PhaseEntry, state, fn)
 	}
+	sm.emit(LifecycleEvent{Kind: LifecycleEnter, State: state})
+	sm.startActivity(state)
 }
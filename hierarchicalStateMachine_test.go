@@ -1,8 +1,12 @@
 package hierarchicalStateMachine
 
 import (
+	"errors"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 var executedActions []string // Track executed actions for verification
@@ -40,6 +44,46 @@ func TestStateMachineInitialization(t *testing.T) {
 	}
 }
 
+func TestStateMachineInitializationWithSelector(t *testing.T) {
+	freshState := State{Entry: []Action{recordAction("Fresh Entry")}}
+	resumedState := State{Entry: []Action{recordAction("Resumed Entry")}}
+	states := []State{freshState, resumedState}
+
+	resume := false
+	selector := func() *State {
+		if resume {
+			return &resumedState
+		}
+		return &freshState
+	}
+
+	for _, resume = range []bool{false, true} {
+		resetExecutedActions()
+
+		sm, err := NewHierarchicalStateMachineFunc(selector, states, nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		expectedState, expectedActions := &freshState, []string{"Fresh Entry"}
+		if resume {
+			expectedState, expectedActions = &resumedState, []string{"Resumed Entry"}
+		}
+		if sm.CurrentState != expectedState {
+			t.Errorf("Expected current state to be %v, got %v", expectedState, sm.CurrentState)
+		}
+		if !reflect.DeepEqual(executedActions, expectedActions) {
+			t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+		}
+	}
+
+	// Check for a selector that picks no state
+	_, err := NewHierarchicalStateMachineFunc(func() *State { return nil }, states, nil)
+	if err == nil {
+		t.Fatalf("Expected an error due to no initial state, got none")
+	}
+}
+
 // TestFlatStateMachine simulates a state machine with no hiearchies and verifies its behavior
 func TestFlatStateMachine(t *testing.T) {
 	resetExecutedActions()
@@ -466,6 +510,99 @@ func TestNestedStates(t *testing.T) {
 	}
 }
 
+func TestCounts(t *testing.T) {
+	editing := State{}
+	previewing := State{}
+	unused := State{}
+
+	transitions := []Transition{
+		{CurrentStates: []*State{&editing, &previewing}, EventName: "close", NextState: &editing},
+		{CurrentState: &editing, EventName: "preview", NextState: &previewing},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&editing, []State{editing, previewing, unused}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the counts are the declared ones, not the discovered states or expanded transitions
+	if stateCount, transitionCount := sm.Counts(); stateCount != 3 || transitionCount != 2 {
+		t.Errorf("Expected 3 states and 2 transitions, got %d and %d", stateCount, transitionCount)
+	}
+}
+
+func TestSkipAncestorHandle(t *testing.T) {
+	resetExecutedActions()
+
+	parentState2 := State{Handle: []Action{recordAction("Parent State 2 Handle")}}
+	parentState := State{
+		Handle:      []Action{recordAction("Parent State Handle")},
+		ParentState: &parentState2,
+	}
+	state1 := State{
+		Handle:             []Action{recordAction("State 1 Handle")},
+		ParentState:        &parentState,
+		SkipAncestorHandle: true,
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, parentState, parentState2}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check only the leaf handles
+	HandleStateMachine(sm)
+	expectedActions := []string{"State 1 Handle"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check an intermediate state can cut off the rest of the hierarchy
+	resetExecutedActions()
+	state1.SkipAncestorHandle = false
+	parentState.SkipAncestorHandle = true
+	HandleStateMachine(sm)
+	expectedActions = []string{"Parent State Handle", "State 1 Handle"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestHandleConsumers(t *testing.T) {
+	consume := true
+
+	parentState := State{}
+	state1 := State{
+		HandleConsumers: []func() bool{func() bool { return consume }},
+		ParentState:     &parentState,
+	}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the consumer blocks the otherwise eligible transition
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+	if sm.LastHandleOutcome() != Consumed {
+		t.Errorf("Expected outcome %v, got %v", Consumed, sm.LastHandleOutcome())
+	}
+
+	consume = false
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
 func TestTransitionWithGuards(t *testing.T) {
 	resetExecutedActions()
 
@@ -501,6 +638,298 @@ func TestTransitionWithGuards(t *testing.T) {
 	}
 }
 
+func TestTransitionWithNilEvent(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+
+	canTransition := false
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Guards:       []Predicate{func() bool { return canTransition }},
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	HandleStateMachine(sm) // Should not transition since canTransition is false
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+
+	canTransition = true
+	HandleStateMachine(sm) // Should transition now without an Event
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestTransitionWithVetoes(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Exit: []Action{recordAction("State 1 Exit")}}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+	state3 := State{Entry: []Action{recordAction("State 3 Entry")}}
+
+	allowed := false
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Vetoes:       []Predicate{func() bool { return allowed }},
+			Actions:      []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:    &state2,
+		},
+		{
+			CurrentState: &state1,
+			NextState:    &state3,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the veto keeps the source state without running exit, actions or entry
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions to run, got %v", executedActions)
+	}
+	if sm.LastHandleOutcome() != Vetoed {
+		t.Errorf("Expected outcome %v, got %v", Vetoed, sm.LastHandleOutcome())
+	}
+
+	allowed = true
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestBeforeTransition(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Exit: []Action{recordAction("State 1 Exit")}}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			EventName:    "go",
+			Actions:      []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	var asked *Transition
+	authorized := false
+	sm.SetBeforeTransition(func(t *Transition) bool {
+		asked = t
+		return authorized
+	})
+
+	// Check the hook cancels the transition without running exit, actions or entry
+	if sm.SendEvent("go") || sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions to run, got %v", executedActions)
+	}
+	if sm.LastHandleOutcome() != Cancelled {
+		t.Errorf("Expected outcome %v, got %v", Cancelled, sm.LastHandleOutcome())
+	}
+	if asked == nil || asked.NextState != &state2 {
+		t.Errorf("Expected the hook to be asked about the transition to %v, got %v", &state2, asked)
+	}
+
+	authorized = true
+	if !sm.SendEvent("go") || sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestTransactionalRTC(t *testing.T) {
+	errFull := errors.New("disk full")
+	newMachine := func(opts ...Option) (*HierarchicalStateMachine, []*State) {
+		resetExecutedActions()
+		idle := State{Name: "idle"}
+		saving := State{Name: "saving", Entry: []Action{recordAction("Saving Entry")}}
+		syncing := State{Name: "syncing", Entry: []Action{recordAction("Syncing Entry")}}
+		done := State{Name: "done", Entry: []Action{recordAction("Done Entry")}}
+
+		transitions := []Transition{
+			{CurrentState: &idle, NextState: &saving},
+			{CurrentState: &saving, OnEntry: true, CheckedActions: []func() error{func() error { return errFull }}, NextState: &syncing},
+			{CurrentState: &syncing, OnEntry: true, NextState: &done},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&idle, []State{idle, saving, syncing, done}, transitions, opts...)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm, []*State{&idle, &saving}
+	}
+
+	// Check the chain stops at the source of the failed transition by default
+	sm, states := newMachine()
+	if err := sm.Handle(); !errors.Is(err, errFull) {
+		t.Errorf("Expected error %v, got %v", errFull, err)
+	}
+	if sm.CurrentState != states[1] {
+		t.Errorf("Expected current state to be %v, got %v", states[1], sm.CurrentState)
+	}
+
+	// Check the machine reverts to the pre-Handle state without further entries
+	sm, states = newMachine(WithTransactionalRTC())
+	if err := sm.Handle(); !errors.Is(err, errFull) {
+		t.Errorf("Expected error %v, got %v", errFull, err)
+	}
+	if sm.CurrentState != states[0] {
+		t.Errorf("Expected current state to be %v, got %v", states[0], sm.CurrentState)
+	}
+	if sm.LastHandleOutcome() != ActionFailed {
+		t.Errorf("Expected outcome %v, got %v", ActionFailed, sm.LastHandleOutcome())
+	}
+	expectedActions := []string{"Saving Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check the reverted transitions are no longer counted
+	for transition, count := range sm.TransitionCounts() {
+		if count != 0 {
+			t.Errorf("Expected transition to %v not to be counted, got %d", transition.NextState, count)
+		}
+	}
+	if stats := sm.DispatchStats(); stats != (DispatchStats{}) {
+		t.Errorf("Expected no dispatches counted, got %+v", stats)
+	}
+}
+
+func TestCheckedActions(t *testing.T) {
+	fail := false
+	newMachine := func(opts ...Option) (*HierarchicalStateMachine, error) {
+		resetExecutedActions()
+		state1 := State{Name: "state1", Exit: []Action{recordAction("State 1 Exit")}}
+		state2 := State{Name: "state2", Entry: []Action{recordAction("State 2 Entry")}}
+
+		transitions := []Transition{
+			{
+				CurrentState: &state1,
+				EventName:    "go",
+				CheckedActions: []func() error{func() error {
+					recordAction("Checked")()
+					if fail {
+						return errors.New("failed")
+					}
+					return nil
+				}},
+				NextState: &state2,
+			},
+		}
+		return NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, opts...)
+	}
+
+	// Check checked actions run between the exits and the entries and are logged
+	sm, err := newMachine(WithActionLog())
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.SendEvent("go")
+	expectedActions := []string{"State 1 Exit", "Checked", "State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+	if log := sm.ActionLog(); len(log) != 3 || log[1] != (ActionEntry{Phase: PhaseTransition, State: "state1"}) {
+		t.Errorf("Expected the checked action in the action log, got %v", log)
+	}
+
+	// Check a dry replay doesn't run them
+	resetExecutedActions()
+	if err := sm.DryReplay([]string{"go"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions to run, got %v", executedActions)
+	}
+
+	// Check a failure in the flattened machine skips the entries too
+	sm, err = newMachine()
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	flat := sm.Flatten()
+	resetExecutedActions()
+	fail = true
+	if err := flat.Dispatch("go").Err; err == nil {
+		t.Errorf("Expected the checked action's error")
+	}
+	expectedActions = []string{"State 1 Exit", "Checked"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check deferred machines reject them
+	if _, err := newMachine(WithDeferredExecution()); err == nil {
+		t.Errorf("Expected an error for checked actions under deferred execution")
+	}
+}
+
+func TestTransitionSkipExitAndEntry(t *testing.T) {
+	resetExecutedActions()
+
+	parentState := State{
+		Entry: []Action{recordAction("Parent State Entry")},
+		Exit:  []Action{recordAction("Parent State Exit")},
+	}
+	state1 := State{
+		Exit:        []Action{recordAction("State 1 Exit")},
+		ParentState: &parentState,
+	}
+	state2 := State{
+		Entry: []Action{recordAction("State 2 Entry")},
+	}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Actions:      []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:    &state2,
+			SkipExit:     true,
+			SkipEntry:    true,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	resetExecutedActions()
+	HandleStateMachine(sm) // Silently move from State 1 to State 2
+
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+	expectedActions := []string{"State 1 -> State 2 Transition"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
 func TestMultipleActionsPerState(t *testing.T) {
 	resetExecutedActions()
 
@@ -582,3 +1011,1845 @@ func TestMultipleActionsPerState(t *testing.T) {
 		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
 	}
 }
+
+func TestTransitionWithGuardGroups(t *testing.T) {
+	pass := func() bool { return true }
+	fail := func() bool { return false }
+
+	tests := []struct {
+		name        string
+		guards      []Predicate
+		guardGroups [][]Predicate
+		expected    bool
+	}{
+		{"no guards or groups", nil, nil, true},
+		{"single group passes", nil, [][]Predicate{{pass, pass}}, true},
+		{"single group partially fails", nil, [][]Predicate{{pass, fail}}, false},
+		{"first group passes", nil, [][]Predicate{{pass}, {fail}}, true},
+		{"second group passes", nil, [][]Predicate{{pass, fail}, {pass}}, true},
+		{"no group passes", nil, [][]Predicate{{fail}, {pass, fail}}, false},
+		{"empty group passes", nil, [][]Predicate{{fail}, {}}, true},
+		{"guards pass and group passes", []Predicate{pass}, [][]Predicate{{fail}, {pass}}, true},
+		{"guards pass and no group passes", []Predicate{pass}, [][]Predicate{{fail}}, false},
+		{"guards fail and group passes", []Predicate{fail}, [][]Predicate{{pass}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state1 := State{}
+			state2 := State{}
+
+			transitions := []Transition{
+				{
+					CurrentState: &state1,
+					Event:        func() bool { return true },
+					Guards:       test.guards,
+					GuardGroups:  test.guardGroups,
+					NextState:    &state2,
+				},
+			}
+
+			sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+			if err != nil {
+				t.Fatalf("failed to initialize state machine: %v", err)
+			}
+
+			HandleStateMachine(sm)
+
+			expectedState := &state1
+			if test.expected {
+				expectedState = &state2
+			}
+			if sm.CurrentState != expectedState {
+				t.Errorf("Expected current state to be %v, got %v", expectedState, sm.CurrentState)
+			}
+		})
+	}
+}
+
+func TestTransitionCounts(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			NextState:    &state2,
+		},
+		{
+			CurrentState: &state2,
+			Event:        func() bool { return true },
+			NextState:    &state1,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	HandleStateMachine(sm) // Transition from State 2 to State 1
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+
+	counts := sm.TransitionCounts()
+	if len(counts) != 2 {
+		t.Fatalf("Expected counts for 2 transitions, got %d", len(counts))
+	}
+	expected := []int{2, 1}
+	for i := range sm.transitions {
+		if count := counts[&sm.transitions[i]]; count != expected[i] {
+			t.Errorf("Expected transition %d to have fired %d times, got %d", i, expected[i], count)
+		}
+	}
+
+	// Check the returned map is a copy
+	counts[&sm.transitions[0]] = 100
+	if sm.TransitionCounts()[&sm.transitions[0]] != 2 {
+		t.Errorf("Expected TransitionCounts to return a copy")
+	}
+}
+
+func TestLastHandleOutcome(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	eventOccurred := false
+	canTransition := false
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return false },
+			NextState:    &state3,
+		},
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return eventOccurred },
+			Guards:       []Predicate{func() bool { return canTransition }},
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	if sm.LastHandleOutcome() != NotHandled {
+		t.Errorf("Expected outcome %v before handling, got %v", NotHandled, sm.LastHandleOutcome())
+	}
+
+	HandleStateMachine(sm) // No event has occurred
+	if sm.LastHandleOutcome() != NoMatchingEvent {
+		t.Errorf("Expected outcome %v, got %v", NoMatchingEvent, sm.LastHandleOutcome())
+	}
+
+	eventOccurred = true
+	HandleStateMachine(sm) // Event occurred but the guard fails
+	if sm.LastHandleOutcome() != GuardBlocked {
+		t.Errorf("Expected outcome %v, got %v", GuardBlocked, sm.LastHandleOutcome())
+	}
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+
+	canTransition = true
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	if sm.LastHandleOutcome() != Transitioned {
+		t.Errorf("Expected outcome %v, got %v", Transitioned, sm.LastHandleOutcome())
+	}
+}
+
+func TestTransitionOnComplete(t *testing.T) {
+	resetExecutedActions()
+
+	parentState := State{
+		Entry: []Action{recordAction("Parent State Entry")},
+	}
+	state1 := State{
+		Exit: []Action{recordAction("State 1 Exit")},
+	}
+	state2 := State{
+		Entry:       []Action{recordAction("State 2 Entry")},
+		ParentState: &parentState,
+	}
+
+	var completedIn *State
+	var sm *HierarchicalStateMachine
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			Actions:      []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:    &state2,
+			OnComplete: func() {
+				completedIn = sm.CurrentState
+				recordAction("State 1 -> State 2 Complete")()
+			},
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	resetExecutedActions()
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+
+	// Check OnComplete runs after the whole entry chain
+	expectedActions := []string{
+		"State 1 Exit", "State 1 -> State 2 Transition",
+		"Parent State Entry", "State 2 Entry", "State 1 -> State 2 Complete"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+	if completedIn != &state2 {
+		t.Errorf("Expected current state during OnComplete to be %v, got %v", &state2, completedIn)
+	}
+}
+
+func TestParallelEntry(t *testing.T) {
+	var mu sync.Mutex
+	var entered []string
+	record := func(name string) Action {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			entered = append(entered, name)
+		}
+	}
+
+	parentState := State{
+		Entry:         []Action{record("Parent Entry 1"), record("Parent Entry 2"), record("Parent Entry 3")},
+		ParallelEntry: true,
+	}
+	state1 := State{}
+	state2 := State{
+		Entry:         []Action{record("State 2 Entry 1"), record("State 2 Entry 2")},
+		ParentState:   &parentState,
+		ParallelEntry: true,
+	}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, parentState}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+
+	// Check all actions ran and the parent level completed before the child level started
+	if len(entered) != 5 {
+		t.Fatalf("Expected 5 entry actions to run, got %v", entered)
+	}
+	parentActions := append([]string{}, entered[:3]...)
+	childActions := append([]string{}, entered[3:]...)
+	sort.Strings(parentActions)
+	sort.Strings(childActions)
+
+	expectedParent := []string{"Parent Entry 1", "Parent Entry 2", "Parent Entry 3"}
+	if !reflect.DeepEqual(parentActions, expectedParent) {
+		t.Errorf("expected parent actions %v first, got %v", expectedParent, entered)
+	}
+	expectedChild := []string{"State 2 Entry 1", "State 2 Entry 2"}
+	if !reflect.DeepEqual(childActions, expectedChild) {
+		t.Errorf("expected child actions %v last, got %v", expectedChild, entered)
+	}
+}
+
+// countingExecutor counts the actions it runs, from any goroutine
+type countingExecutor struct {
+	mu  sync.Mutex
+	ran int
+}
+
+func (e *countingExecutor) Run(action Action) {
+	e.mu.Lock()
+	e.ran++
+	e.mu.Unlock()
+	action()
+}
+
+func TestParallelEntryPerAction(t *testing.T) {
+	var mu sync.Mutex
+	ran := 0
+	count := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		ran++
+	}
+	state1 := State{Name: "state1"}
+	state2 := State{
+		Name:          "state2",
+		Entry:         []Action{count, func() { panic("boom") }, count},
+		ParallelEntry: true,
+	}
+
+	transitions := []Transition{{CurrentState: &state1, EventName: "go", NextState: &state2}}
+
+	executor := &countingExecutor{}
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions,
+		WithPanicPolicy(PhaseEntry, Recover), WithActionLog(), WithExecutor(executor))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the panic is recovered and the other actions still run
+	if !sm.SendEvent("go") || sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+	if ran != 2 {
+		t.Errorf("Expected the other 2 actions to run, got %d", ran)
+	}
+
+	// Check each action is run by the executor and logged by itself
+	if executor.ran != 3 {
+		t.Errorf("Expected the executor to run 3 actions, got %d", executor.ran)
+	}
+	if log := sm.ActionLog(); len(log) != 3 {
+		t.Errorf("Expected 3 action log entries, got %v", log)
+	}
+}
+
+// composite routes to childA or childB on entry depending on a guard, with childB as default
+func TestInitialChoice(t *testing.T) {
+	useA := false
+
+	outside := State{Exit: []Action{recordAction("Outside Exit")}}
+	composite := State{Entry: []Action{recordAction("Composite Entry")}}
+	childA := State{Entry: []Action{recordAction("Child A Entry")}, ParentState: &composite}
+	childB := State{Entry: []Action{recordAction("Child B Entry")}, ParentState: &composite}
+	composite.Initial = &childB
+	composite.InitialChoices = []InitialChoice{{Guard: func() bool { return useA }, State: &childA}}
+
+	states := []State{outside, composite, childA, childB}
+
+	for _, useA = range []bool{false, true} {
+		transitions := []Transition{
+			{
+				CurrentState: &outside,
+				Event:        func() bool { return true },
+				NextState:    &composite,
+			},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&outside, states, transitions)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+
+		resetExecutedActions()
+		HandleStateMachine(sm) // Transition from Outside to Composite
+
+		expectedState := &childB
+		expectedActions := []string{"Outside Exit", "Composite Entry", "Child B Entry"}
+		if useA {
+			expectedState = &childA
+			expectedActions = []string{"Outside Exit", "Composite Entry", "Child A Entry"}
+		}
+		if sm.CurrentState != expectedState {
+			t.Errorf("Expected current state to be %v, got %v", expectedState, sm.CurrentState)
+		}
+		if !reflect.DeepEqual(executedActions, expectedActions) {
+			t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+		}
+	}
+
+	// Check the initial state itself is resolved at construction
+	sm, err := NewHierarchicalStateMachine(&composite, states, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if sm.CurrentState != &childA {
+		t.Errorf("Expected current state to be %v, got %v", &childA, sm.CurrentState)
+	}
+
+	// Check choices without a default are rejected
+	composite.Initial = nil
+	_, err = NewHierarchicalStateMachine(&outside, states, []Transition{{CurrentState: &outside, NextState: &composite}})
+	if err == nil {
+		t.Fatalf("Expected an error due to a missing default initial state, got none")
+	}
+}
+
+func TestPreAndPostHandleHooks(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Handle: []Action{recordAction("State 1 Handle")}}
+	state2 := State{Handle: []Action{recordAction("State 2 Handle")}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	var preStates, postStates []*State
+	var postFired []*Transition
+	sm.SetPreHandle(func(current *State) {
+		preStates = append(preStates, current)
+		recordAction("Pre Handle")()
+	})
+	sm.SetPostHandle(func(current *State, fired *Transition) {
+		postStates = append(postStates, current)
+		postFired = append(postFired, fired)
+		recordAction("Post Handle")()
+	})
+
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+	HandleStateMachine(sm) // No transition from State 2
+
+	// Check the hooks wrap every call
+	expectedActions := []string{"Pre Handle", "State 1 Handle", "Post Handle", "Pre Handle", "State 2 Handle", "Post Handle"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check the hook arguments
+	if !reflect.DeepEqual(preStates, []*State{&state1, &state2}) {
+		t.Errorf("Expected pre handle states %v, got %v", []*State{&state1, &state2}, preStates)
+	}
+	if !reflect.DeepEqual(postStates, []*State{&state2, &state2}) {
+		t.Errorf("Expected post handle states %v, got %v", []*State{&state2, &state2}, postStates)
+	}
+	if !reflect.DeepEqual(postFired, []*Transition{&sm.transitions[0], nil}) {
+		t.Errorf("Expected fired transitions %v, got %v", []*Transition{&sm.transitions[0], nil}, postFired)
+	}
+}
+
+func TestMachineContext(t *testing.T) {
+	type services struct{ greeting string }
+
+	var sm *HierarchicalStateMachine
+	var received string
+
+	state1 := State{}
+	state2 := State{}
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			Actions: []Action{func() {
+				received = sm.Context().(*services).greeting
+			}},
+			NextState: &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	sm.SetContext(&services{greeting: "hello"})
+	HandleStateMachine(sm) // Transition from State 1 to State 2
+
+	if received != "hello" {
+		t.Errorf("Expected action to read %q from the context, got %q", "hello", received)
+	}
+}
+
+func TestMergeStateMachines(t *testing.T) {
+	resetExecutedActions()
+
+	parentA := State{Name: "parentA", Exit: []Action{recordAction("Parent A Exit")}}
+	stateA1 := State{Name: "a1", ParentState: &parentA}
+	stateA2 := State{Name: "a2", ParentState: &parentA, Exit: []Action{recordAction("A2 Exit")}}
+	stateB1 := State{Name: "b1", Entry: []Action{recordAction("B1 Entry")}}
+	stateB2 := State{Name: "b2"}
+
+	linkEnabled := false
+
+	a, err := NewHierarchicalStateMachine(&stateA1, []State{stateA1, stateA2, parentA}, []Transition{
+		{CurrentState: &stateA1, NextState: &stateA2},
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	b, err := NewHierarchicalStateMachine(&stateB1, []State{stateB1, stateB2}, []Transition{
+		{CurrentState: &stateB1, NextState: &stateB2},
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	link := []Transition{
+		{
+			CurrentState: &stateA2,
+			Guards:       []Predicate{func() bool { return linkEnabled }},
+			Actions:      []Action{recordAction("A2 -> B1 Transition")},
+			NextState:    &stateB1,
+		},
+	}
+
+	merged, err := Merge(a, b, link)
+	if err != nil {
+		t.Fatalf("failed to merge state machines: %v", err)
+	}
+	if merged.CurrentState != &stateA1 {
+		t.Errorf("Expected current state to be %v, got %v", &stateA1, merged.CurrentState)
+	}
+
+	HandleStateMachine(merged) // Transition from A1 to A2
+	if merged.CurrentState != &stateA2 {
+		t.Errorf("Expected current state to be %v, got %v", &stateA2, merged.CurrentState)
+	}
+
+	// Check the cross-machine transition keeps each machine's hierarchy
+	resetExecutedActions()
+	linkEnabled = true
+	HandleStateMachine(merged) // Transition from A2 to B1
+	if merged.CurrentState != &stateB1 {
+		t.Errorf("Expected current state to be %v, got %v", &stateB1, merged.CurrentState)
+	}
+	expectedActions := []string{"A2 Exit", "Parent A Exit", "A2 -> B1 Transition", "B1 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check duplicate state names are rejected
+	duplicate := State{Name: "a1"}
+	c, err := NewHierarchicalStateMachine(&duplicate, []State{duplicate}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if _, err := Merge(a, c, nil); err == nil {
+		t.Fatalf("Expected an error due to duplicate state names, got none")
+	}
+}
+
+func TestDeferredExecution(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{
+		Exit:   []Action{recordAction("State 1 Exit")},
+		Handle: []Action{recordAction("State 1 Handle")},
+	}
+	state2 := State{
+		Entry: []Action{recordAction("State 2 Entry")},
+	}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			Actions:      []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithDeferredExecution())
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	HandleStateMachine(sm) // Compute the transition from State 1 to State 2
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check discarding runs nothing and reverts the state
+	sm.Discard()
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions to run, got %v", executedActions)
+	}
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+	if count := sm.TransitionCounts()[&sm.transitions[0]]; count != 0 {
+		t.Errorf("Expected discarded transition not to be counted, got %d", count)
+	}
+
+	// Check flushing commits the buffered actions in order
+	HandleStateMachine(sm) // Compute the transition from State 1 to State 2 again
+	sm.Flush()
+	expectedActions := []string{"State 1 Handle", "State 1 Exit", "State 1 -> State 2 Transition", "State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check a discard after a flush has nothing to revert
+	sm.Discard()
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestReentrantHandle(t *testing.T) {
+	resetExecutedActions()
+
+	var sm *HierarchicalStateMachine
+
+	state1 := State{}
+	state2 := State{
+		Entry: []Action{
+			recordAction("State 2 Entry Start"),
+			func() { HandleStateMachine(sm) },
+			recordAction("State 2 Entry End"),
+		},
+		Exit: []Action{recordAction("State 2 Exit")},
+	}
+	state3 := State{Entry: []Action{recordAction("State 3 Entry")}}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state3},
+	}
+
+	// Check a queued call runs after the current one completes
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions, WithReentrancyPolicy(ReentrancyQueue))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	HandleStateMachine(sm) // Transition from State 1 to State 2, then the queued one to State 3
+	if sm.CurrentState != &state3 {
+		t.Errorf("Expected current state to be %v, got %v", &state3, sm.CurrentState)
+	}
+	expectedActions := []string{"State 2 Entry Start", "State 2 Entry End", "State 2 Exit", "State 3 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check the default policy panics
+	sm, err = NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a reentrant call to panic")
+			}
+		}()
+		HandleStateMachine(sm)
+	}()
+
+	// Check the machine is usable after the panic was recovered
+	state2.Entry = nil
+	sm.CurrentState = &state2
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state3 {
+		t.Errorf("Expected current state to be %v, got %v", &state3, sm.CurrentState)
+	}
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+	states := []State{state1, state2, state3}
+
+	// Both transitions are eligible on "go"
+	overlapping := []Transition{
+		{CurrentState: &state1, EventName: "go", Priority: 1, NextState: &state2},
+		{CurrentState: &state1, EventName: "go", Priority: 2, NextState: &state3},
+	}
+
+	// Check FirstMatch fires the first declared transition
+	sm, err := NewHierarchicalStateMachine(&state1, states, overlapping, WithDuplicatePolicy(FirstMatch))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.SendEvent("go")
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check HighestPriority fires the higher priority transition
+	sm, err = NewHierarchicalStateMachine(&state1, states, overlapping, WithDuplicatePolicy(HighestPriority))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.SendEvent("go")
+	if sm.CurrentState != &state3 {
+		t.Errorf("Expected current state to be %v, got %v", &state3, sm.CurrentState)
+	}
+
+	// Check Error rejects the overlapping pair
+	_, err = NewHierarchicalStateMachine(&state1, states, overlapping, WithDuplicatePolicy(Error))
+	if err == nil {
+		t.Fatalf("Expected an error due to overlapping transitions, got none")
+	}
+
+	// Check Error accepts transitions on different events
+	distinct := []Transition{
+		{CurrentState: &state1, EventName: "go", NextState: &state2},
+		{CurrentState: &state1, EventName: "stop", NextState: &state3},
+	}
+	if _, err = NewHierarchicalStateMachine(&state1, states, distinct, WithDuplicatePolicy(Error)); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestConcurrentMetricsReads(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	const handles = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < handles; i++ {
+			HandleStateMachine(sm)
+		}
+	}()
+
+	// Check counts only ever grow while transitions fire
+	last := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		total := 0
+		for _, count := range sm.TransitionCounts() {
+			total += count
+		}
+		if total < last {
+			t.Fatalf("Expected monotonic transition counts, went from %d to %d", last, total)
+		}
+		last = total
+		_ = sm.TimeInState()
+		if snapshot := sm.MetricsSnapshot(); !containsState(snapshot.States, snapshot.CurrentState) {
+			t.Fatalf("Expected the known states to include the current state %v, got %v", snapshot.CurrentState, snapshot.States)
+		}
+	}
+
+	if last != handles {
+		t.Errorf("Expected %d transitions, got %d", handles, last)
+	}
+}
+
+func TestGuardErrorPolicy(t *testing.T) {
+	errUndecided := errors.New("sensor offline")
+
+	policies := []struct {
+		policy   GuardErrorPolicy
+		outcome  HandleOutcome
+		wantErr  bool
+		expected string
+	}{
+		{GuardErrorSkip, Transitioned, false, "fallback"},
+		{GuardErrorAbort, GuardErrored, true, "idle"},
+		{GuardErrorRoute, GuardErrored, false, "failed"},
+	}
+
+	for _, tc := range policies {
+		idle := State{Name: "idle"}
+		active := State{Name: "active"}
+		fallback := State{Name: "fallback"}
+		failed := State{Name: "failed"}
+
+		transitions := []Transition{
+			{
+				CurrentState:  &idle,
+				CheckedGuards: []func() (bool, error){func() (bool, error) { return false, errUndecided }},
+				NextState:     &active,
+			},
+			{CurrentState: &idle, NextState: &fallback},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&idle, []State{idle, active, fallback, failed}, transitions,
+			WithGuardErrorPolicy(tc.policy), WithErrorState(&failed))
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+
+		// Check each policy's outcome, error and resulting state
+		err = sm.Handle()
+		if tc.wantErr != (err != nil) {
+			t.Errorf("Expected error %v under policy %d, got %v", tc.wantErr, tc.policy, err)
+		}
+		if err != nil && !errors.Is(err, errUndecided) {
+			t.Errorf("Expected error to wrap %v, got %v", errUndecided, err)
+		}
+		if sm.LastHandleOutcome() != tc.outcome {
+			t.Errorf("Expected outcome %v under policy %d, got %v", tc.outcome, tc.policy, sm.LastHandleOutcome())
+		}
+		if sm.CurrentState.Name != StateName(tc.expected) {
+			t.Errorf("Expected current state %q under policy %d, got %q", tc.expected, tc.policy, sm.CurrentState.Name)
+		}
+	}
+
+	// Check routing requires an error state
+	state := State{}
+	if _, err := NewHierarchicalStateMachine(&state, []State{state}, nil, WithGuardErrorPolicy(GuardErrorRoute)); err == nil {
+		t.Errorf("Expected initialization to fail without an error state")
+	}
+}
+
+func TestPrecondition(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Handle: []Action{recordAction("State 1 Handle")}}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state1, EventName: "go", NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	errNotReady := errors.New("system not ready")
+	ready := false
+	sm.Precondition(func() error {
+		if !ready {
+			return errNotReady
+		}
+		return nil
+	})
+
+	// Check a failing precondition blocks the handle entirely
+	err = sm.Handle()
+	if !errors.Is(err, errNotReady) {
+		t.Errorf("Expected error %v, got %v", errNotReady, err)
+	}
+	if sm.CurrentState != &state1 || len(executedActions) != 0 {
+		t.Errorf("Expected to stay in %v without actions, got %v and %v", &state1, sm.CurrentState, executedActions)
+	}
+	if sm.LastHandleOutcome() != PreconditionFailed {
+		t.Errorf("Expected outcome %v, got %v", PreconditionFailed, sm.LastHandleOutcome())
+	}
+
+	// Check it blocks named events too
+	if result := sm.Dispatch("go"); result.Fired || !errors.Is(result.Err, errNotReady) {
+		t.Errorf("Expected error %v without a transition, got %+v", errNotReady, result)
+	}
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+
+	// Check the handle proceeds once the precondition passes
+	ready = true
+	if err := sm.Handle(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestOnFirstEnter(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Name: "state1"}
+	state2 := State{Name: "state2", Entry: []Action{recordAction("State 2 Entry")}}
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.OnFirstEnter("state2", recordAction("State 2 First Enter"))
+	sm.OnFirstEnter("state1", recordAction("State 1 First Enter"))
+
+	// Check the callback runs before Entry on the first entry only, and not for the initial state
+	for i := 0; i < 4; i++ {
+		HandleStateMachine(sm)
+	}
+	expectedActions := []string{"State 2 First Enter", "State 2 Entry", "State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestOnFirstEnterDropped(t *testing.T) {
+	newMachine := func(opts ...Option) *HierarchicalStateMachine {
+		resetExecutedActions()
+		state1 := State{Name: "state1"}
+		state2 := State{Name: "state2"}
+
+		transitions := []Transition{{CurrentState: &state1, EventName: "go", NextState: &state2}}
+
+		sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, opts...)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		sm.OnFirstEnter("state2", recordAction("State 2 First Enter"))
+		return sm
+	}
+	expectedActions := []string{"State 2 First Enter"}
+
+	// Check a discarded entry doesn't count as the first one
+	sm := newMachine(WithDeferredExecution())
+	sm.SendEvent("go")
+	sm.Discard()
+	sm.SendEvent("go")
+	sm.Flush()
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check neither does a dry replayed one
+	sm = newMachine()
+	if err := sm.DryReplay([]string{"go"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	sm.Replay([]string{"go"})
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestReparent(t *testing.T) {
+	resetExecutedActions()
+
+	parent1 := State{Name: "parent1", Exit: []Action{recordAction("Parent 1 Exit")}}
+	parent2 := State{Name: "parent2", Entry: []Action{recordAction("Parent 2 Entry")}}
+	state1 := State{Name: "state1", ParentState: &parent1, Exit: []Action{recordAction("State 1 Exit")}}
+	state2 := State{Name: "state2", ParentState: &parent1, Entry: []Action{recordAction("State 2 Entry")}}
+	parent1.Initial = &state1
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &parent2, NextState: &parent1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&parent1, []State{parent1, parent2, state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check invalid moves are rejected and leave the hierarchy alone
+	if err := sm.Reparent(&state1, &parent2); err == nil {
+		t.Errorf("Expected reparenting the active state to fail")
+	}
+	if err := sm.Reparent(&parent1, &state2); err == nil {
+		t.Errorf("Expected reparenting a state under its own descendant to fail")
+	}
+	if err := sm.Reparent(&state2, &State{}); err == nil {
+		t.Errorf("Expected reparenting under an unknown state to fail")
+	}
+	if state2.ParentState != &parent1 {
+		t.Errorf("Expected parent of state2 to stay %v, got %v", &parent1, state2.ParentState)
+	}
+
+	// Check the transition now leaves parent1 and enters parent2
+	if err := sm.Reparent(&state2, &parent2); err != nil {
+		t.Fatalf("Expected reparenting to succeed, got %v", err)
+	}
+	resetExecutedActions()
+	HandleStateMachine(sm)
+	expectedActions := []string{"State 1 Exit", "Parent 1 Exit", "Parent 2 Entry", "State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestOnRegionExit(t *testing.T) {
+	resetExecutedActions()
+
+	region := State{Name: "region", Exit: []Action{recordAction("Region Exit")}}
+	state1 := State{Name: "state1", ParentState: &region}
+	state2 := State{Name: "state2", ParentState: &region}
+	outside := State{Name: "outside"}
+	region.Initial = &state1
+
+	transitions := []Transition{
+		{CurrentState: &state1, NextState: &state2},
+		{CurrentState: &state2, NextState: &outside},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&region, []State{region, state1, state2, outside}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.OnRegionExit(&region, recordAction("Left Region"))
+
+	// Check an intra-region transition doesn't run the region-exit action
+	HandleStateMachine(sm)
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions inside the region, got %v", executedActions)
+	}
+
+	// Check leaving the region runs it after the region's Exit actions
+	HandleStateMachine(sm)
+	expectedActions := []string{"Region Exit", "Left Region"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestNilFuncValidation(t *testing.T) {
+	state1 := State{Name: "state1"}
+	state2 := State{Name: "state2"}
+
+	// Check a nil Event is accepted, since it means the event always occurs
+	transitions := []Transition{{CurrentState: &state1, NextState: &state2}}
+	if _, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions); err != nil {
+		t.Errorf("Expected a nil Event to be accepted, got %v", err)
+	}
+
+	// Check nil entries are rejected before they can panic
+	invalid := []Transition{
+		{CurrentState: &state1, Guards: []Predicate{nil}, NextState: &state2},
+		{CurrentState: &state1, GuardGroups: [][]Predicate{{nil}}, NextState: &state2},
+		{CurrentState: &state1, Vetoes: []Predicate{nil}, NextState: &state2},
+		{CurrentState: &state1, Actions: []Action{nil}, NextState: &state2},
+	}
+	for _, transition := range invalid {
+		if _, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, []Transition{transition}); err == nil {
+			t.Errorf("Expected initialization to fail for %+v", transition)
+		}
+	}
+
+	state3 := State{Entry: []Action{nil}}
+	if _, err := NewHierarchicalStateMachine(&state3, []State{state3}, nil); err == nil {
+		t.Errorf("Expected initialization to fail for a nil Entry action")
+	}
+}
+
+func TestEntryWithReason(t *testing.T) {
+	var reasons []EntryReason
+	record := func(reason EntryReason) { reasons = append(reasons, reason) }
+
+	parent := State{Name: "parent", EntryWithReason: []func(EntryReason){record}}
+	child := State{Name: "child", ParentState: &parent, EntryWithReason: []func(EntryReason){record}}
+	parent.Initial = &child
+	other := State{Name: "other"}
+
+	transitions := []Transition{
+		{CurrentState: &child, NextState: &other},
+		{CurrentState: &other, NextState: &parent},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&parent, []State{parent, child, other}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the machine's initial entry
+	expected := []EntryReason{EntryInitial, EntryInitial}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("Expected entry reasons %v, got %v", expected, reasons)
+	}
+
+	// Check the target is entered normally and its initial descendant as initial
+	reasons = nil
+	HandleStateMachine(sm)
+	HandleStateMachine(sm)
+	expected = []EntryReason{EntryNormal, EntryInitial}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("Expected entry reasons %v, got %v", expected, reasons)
+	}
+}
+
+func TestOnRegionEnter(t *testing.T) {
+	resetExecutedActions()
+
+	outside := State{Name: "outside"}
+	region := State{Name: "region", Entry: []Action{recordAction("Region Entry")}}
+	state1 := State{Name: "state1", ParentState: &region}
+	state2 := State{Name: "state2", ParentState: &region}
+	region.Initial = &state1
+
+	transitions := []Transition{
+		{CurrentState: &outside, NextState: &region},
+		{CurrentState: &state1, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&outside, []State{outside, region, state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	sm.OnRegionEnter(&region, recordAction("Entered Region"))
+
+	// Check coming from outside runs the region-enter callback after the region's Entry actions
+	HandleStateMachine(sm)
+	expectedActions := []string{"Region Entry", "Entered Region"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check a sibling-to-sibling move inside the region doesn't
+	resetExecutedActions()
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 || len(executedActions) != 0 {
+		t.Errorf("Expected to move to %v without actions, got %v and %v", &state2, sm.CurrentState, executedActions)
+	}
+}
+
+func TestFromDescendants(t *testing.T) {
+	resetExecutedActions()
+
+	payment := State{Name: "payment", Exit: []Action{recordAction("Payment Exit")}}
+	card := State{Name: "card", ParentState: &payment, Exit: []Action{recordAction("Card Exit")}}
+	bank := State{Name: "bank", ParentState: &payment}
+	failed := State{Name: "failed"}
+	payment.Initial = &card
+
+	transitions := []Transition{
+		{CurrentState: &card, EventName: "switch", NextState: &bank},
+		{CurrentState: &payment, EventName: "error", FromDescendants: true, NextState: &failed},
+		{CurrentState: &failed, EventName: "retry", NextState: &bank},
+		{CurrentState: &bank, EventName: "error", Guards: []Predicate{func() bool { return false }}, NextState: &card},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&payment, []State{payment, card, bank, failed}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the scoped transition fires from the first leaf, exiting from the leaf up
+	if !sm.SendEvent("error") || sm.CurrentState != &failed {
+		t.Errorf("Expected the region-wide transition to reach %v, got %v", &failed, sm.CurrentState)
+	}
+	expectedActions := []string{"Card Exit", "Payment Exit"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check it doesn't fire from outside the region
+	if sm.SendEvent("error") {
+		t.Errorf("Expected no transition from %v", &failed)
+	}
+
+	// Check it fires from another leaf once the leaf's own transition on the event is blocked
+	sm.SendEvent("retry")
+	if !sm.SendEvent("error") || sm.CurrentState != &failed {
+		t.Errorf("Expected the region-wide transition to reach %v, got %v", &failed, sm.CurrentState)
+	}
+}
+
+func TestEventPropagation(t *testing.T) {
+	newMachine := func(opts ...Option) (*HierarchicalStateMachine, *State) {
+		resetExecutedActions()
+		app := State{Name: "app", Exit: []Action{recordAction("App Exit")}}
+		editor := State{Name: "editor", ParentState: &app}
+		cursor := State{Name: "cursor", ParentState: &editor, Exit: []Action{recordAction("Cursor Exit")}}
+		closed := State{Name: "closed"}
+		app.Initial = &editor
+		editor.Initial = &cursor
+
+		transitions := []Transition{
+			{CurrentState: &cursor, EventName: "move", NextState: &cursor},
+			{CurrentState: &app, EventName: "quit", NextState: &closed},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&app, []State{app, editor, cursor, closed}, transitions, opts...)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm, &closed
+	}
+
+	// Check the leaf ignores the grandparent's event by default
+	sm, _ := newMachine()
+	if sm.SendEvent("quit") || sm.CurrentState.Name != "cursor" {
+		t.Errorf("Expected no transition from cursor, got %v", sm.CurrentState)
+	}
+
+	// Check the grandparent's transition fires under bubbling, exiting from the leaf up
+	sm, closed := newMachine(WithEventPropagation(PropagationBubbling))
+	if !sm.SendEvent("quit") || sm.CurrentState != closed {
+		t.Errorf("Expected the grandparent's transition to reach %v, got %v", closed, sm.CurrentState)
+	}
+	expectedActions := []string{"Cursor Exit", "App Exit"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestElseActions(t *testing.T) {
+	resetExecutedActions()
+
+	balance := 5
+	cart := State{Name: "cart", Exit: []Action{recordAction("Cart Exit")}}
+	paid := State{Name: "paid", Entry: []Action{recordAction("Paid Entry")}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &cart,
+			EventName:    "pay",
+			Guards:       []Predicate{func() bool { return balance >= 10 }},
+			Actions:      []Action{recordAction("Pay")},
+			ElseActions:  []Action{recordAction("Balance Too Low")},
+			NextState:    &paid,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&cart, []State{cart, paid}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the else actions run and the state stays put when the guard blocks
+	if sm.SendEvent("pay") || sm.CurrentState != &cart {
+		t.Errorf("Expected to stay in %v, got %v", &cart, sm.CurrentState)
+	}
+	expectedActions := []string{"Balance Too Low"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check they don't run once the transition fires
+	resetExecutedActions()
+	balance = 10
+	if !sm.SendEvent("pay") {
+		t.Errorf("Expected the transition to fire")
+	}
+	expectedActions = []string{"Cart Exit", "Pay", "Paid Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestTieBreaker(t *testing.T) {
+	newMachine := func(opts ...Option) *HierarchicalStateMachine {
+		state1 := State{}
+		alpha := State{Name: "alpha"}
+		beta := State{Name: "beta"}
+
+		transitions := []Transition{
+			{CurrentState: &state1, EventName: "go", Priority: 1, NextState: &beta},
+			{CurrentState: &state1, EventName: "go", Priority: 1, NextState: &alpha},
+		}
+
+		opts = append([]Option{WithDuplicatePolicy(HighestPriority)}, opts...)
+		sm, err := NewHierarchicalStateMachine(&state1, []State{state1, alpha, beta}, transitions, opts...)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm
+	}
+
+	// Check the default keeps declaration order
+	sm := newMachine()
+	sm.SendEvent("go")
+	if sm.CurrentState.Name != "beta" {
+		t.Errorf("Expected current state %q, got %q", "beta", sm.CurrentState.Name)
+	}
+
+	// Check the tie-breaker picks by target name
+	sm = newMachine(WithTieBreaker(func(a, b *Transition) bool { return a.NextState.Name < b.NextState.Name }))
+	sm.SendEvent("go")
+	if sm.CurrentState.Name != "alpha" {
+		t.Errorf("Expected current state %q, got %q", "alpha", sm.CurrentState.Name)
+	}
+}
+
+func TestStepMode(t *testing.T) {
+	newMachine := func(opts ...Option) *HierarchicalStateMachine {
+		parent1 := State{Exit: []Action{recordAction("Parent 1 Exit")}}
+		state1 := State{ParentState: &parent1, Exit: []Action{recordAction("State 1 Exit")}}
+		parent2 := State{Entry: []Action{recordAction("Parent 2 Entry")}}
+		state2 := State{ParentState: &parent2, Entry: []Action{recordAction("State 2 Entry")}}
+		parent2.Initial = &state2
+
+		transitions := []Transition{
+			{CurrentState: &state1, Actions: []Action{recordAction("State 1 -> Parent 2 Transition")}, NextState: &parent2},
+		}
+
+		sm, err := NewHierarchicalStateMachine(&state1, []State{parent1, state1, parent2, state2}, transitions, opts...)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm
+	}
+
+	sm := newMachine()
+	resetExecutedActions()
+	HandleStateMachine(sm)
+	expectedActions := append([]string(nil), executedActions...)
+
+	// Check nothing runs until stepped, then one action runs per step in the same order
+	sm = newMachine(WithStepMode())
+	resetExecutedActions()
+	HandleStateMachine(sm)
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions before stepping, got %v", executedActions)
+	}
+	for step := 1; step <= len(expectedActions); step++ {
+		done := sm.StepAction()
+		if !reflect.DeepEqual(executedActions, expectedActions[:step]) {
+			t.Errorf("Expected actions %v after step %d, got %v", expectedActions[:step], step, executedActions)
+		}
+		if done != (step == len(expectedActions)) {
+			t.Errorf("Expected done to be %v after step %d", step == len(expectedActions), step)
+		}
+	}
+	if !sm.StepAction() {
+		t.Errorf("Expected stepping with nothing buffered to report done")
+	}
+}
+
+func TestInitialState(t *testing.T) {
+	parent := State{}
+	state1 := State{ParentState: &parent}
+	state2 := State{}
+	parent.Initial = &state1
+
+	transitions := []Transition{{CurrentState: &state1, NextState: &state2}}
+
+	sm, err := NewHierarchicalStateMachine(&parent, []State{parent, state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the constructor's state is returned even after settling and transitioning elsewhere
+	HandleStateMachine(sm)
+	if sm.InitialState() != &parent {
+		t.Errorf("Expected initial state to be %v, got %v", &parent, sm.InitialState())
+	}
+}
+
+func TestReverseExitOrder(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{
+		Exit: []Action{
+			recordAction("Release 1"),
+			recordAction("Release 2"),
+			recordAction("Release 3"),
+		},
+		ReverseExitOrder: true,
+	}
+	state2 := State{}
+
+	transitions := []Transition{{CurrentState: &state1, NextState: &state2}}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the Exit actions ran last to first
+	HandleStateMachine(sm)
+	expectedActions := []string{"Release 3", "Release 2", "Release 1"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	parent := State{Name: "parent"}
+	child := State{Name: "child", ParentState: &parent}
+	parent.Initial = &child
+	other := State{Name: "other"}
+
+	transitions := []Transition{{CurrentState: &child, NextState: &other, EventName: "go"}}
+
+	sm, err := NewHierarchicalStateMachine(&parent, []State{parent, child, other}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check a freshly constructed machine passes
+	if err := sm.SelfCheck(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	// Check an unregistered current state is reported
+	stray := State{Name: "stray"}
+	sm.CurrentState = &stray
+	if err := sm.SelfCheck(); err == nil {
+		t.Errorf("Expected an error for an unregistered current state, got nil")
+	}
+
+	// Check resting on a composite is reported
+	sm.CurrentState = &parent
+	if err := sm.SelfCheck(); err == nil {
+		t.Errorf("Expected an error for a composite current state, got nil")
+	}
+}
+
+func TestTargetPrecondition(t *testing.T) {
+	resetExecutedActions()
+
+	ready := false
+	state1 := State{Exit: []Action{recordAction("State 1 Exit")}}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+
+	transitions := []Transition{
+		{
+			CurrentState:       &state1,
+			Actions:            []Action{recordAction("State 1 -> State 2 Transition")},
+			NextState:          &state2,
+			TargetPrecondition: func() bool { return ready },
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check a failing target precondition leaves the machine in its source with nothing run
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state1 {
+		t.Errorf("Expected current state to be %v, got %v", &state1, sm.CurrentState)
+	}
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions, got %v", executedActions)
+	}
+	if sm.LastHandleOutcome() != TargetNotReady {
+		t.Errorf("Expected outcome %v, got %v", TargetNotReady, sm.LastHandleOutcome())
+	}
+
+	// Check the transition fires once the target is ready
+	ready = true
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
+
+func TestPathActions(t *testing.T) {
+	resetExecutedActions()
+
+	outer := State{Exit: []Action{recordAction("Outer Exit")}}
+	inner := State{ParentState: &outer, Exit: []Action{recordAction("Inner Exit")}}
+	leaf := State{ParentState: &inner, Exit: []Action{recordAction("Leaf Exit")}}
+	target := State{Entry: []Action{recordAction("Target Entry")}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &leaf,
+			Actions:      []Action{recordAction("Leaf -> Target Transition")},
+			NextState:    &target,
+			PathActions:  map[*State][]Action{&inner: {recordAction("Inner Path")}},
+		},
+		{CurrentState: &target, EventName: "back", NextState: &leaf},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&leaf, []State{outer, inner, leaf, target}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the path action runs as the exit path crosses the intermediate composite
+	HandleStateMachine(sm)
+	expectedActions := []string{"Leaf Exit", "Inner Exit", "Inner Path", "Outer Exit", "Leaf -> Target Transition", "Target Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check other transitions crossing the composite don't run it
+	resetExecutedActions()
+	sm.SendEvent("back")
+	for _, action := range executedActions {
+		if action == "Inner Path" {
+			t.Errorf("Expected path action not to run, got %v", executedActions)
+		}
+	}
+}
+
+func TestOnEntryTransition(t *testing.T) {
+	resetExecutedActions()
+
+	decision := "accept"
+	idle := State{}
+	review := State{Entry: []Action{recordAction("Review Entry")}, Exit: []Action{recordAction("Review Exit")}}
+	accepted := State{Entry: []Action{recordAction("Accepted Entry")}}
+	rejected := State{}
+
+	transitions := []Transition{
+		{CurrentState: &idle, EventName: "submit", NextState: &review},
+		{CurrentState: &review, OnEntry: true, Guards: []Predicate{func() bool { return decision == "accept" }}, NextState: &accepted},
+		{CurrentState: &review, OnEntry: true, Guards: []Predicate{func() bool { return decision == "reject" }}, NextState: &rejected},
+		{CurrentState: &accepted, EventName: "reset", NextState: &idle},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&idle, []State{idle, review, accepted, rejected}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check entering the state advances immediately within the same dispatch
+	if !sm.SendEvent("submit") {
+		t.Errorf("Expected event %q to fire a transition", "submit")
+	}
+	if sm.CurrentState != &accepted {
+		t.Errorf("Expected current state to be %v, got %v", &accepted, sm.CurrentState)
+	}
+	expectedActions := []string{"Review Entry", "Review Exit", "Accepted Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check the state stays put when no on-entry transition passes
+	sm.SendEvent("reset")
+	decision = ""
+	sm.SendEvent("submit")
+	if sm.CurrentState != &review {
+		t.Errorf("Expected current state to be %v, got %v", &review, sm.CurrentState)
+	}
+
+	// Check on-entry transitions are not evaluated again at rest
+	decision = "reject"
+	HandleStateMachine(sm)
+	if sm.CurrentState != &review {
+		t.Errorf("Expected current state to be %v, got %v", &review, sm.CurrentState)
+	}
+}
+
+func TestInvertGuards(t *testing.T) {
+	busy := true
+	maintenance := false
+	idle := State{}
+	working := State{}
+
+	transitions := []Transition{
+		{
+			CurrentState: &idle,
+			EventName:    "start",
+			GuardGroups:  [][]Predicate{{func() bool { return busy }}, {func() bool { return maintenance }}},
+			InvertGuards: true,
+			NextState:    &working,
+		},
+		{CurrentState: &working, EventName: "stop", NextState: &idle},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&idle, []State{idle, working}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the transition is blocked while any group passes
+	if sm.SendEvent("start") {
+		t.Errorf("Expected event %q not to fire a transition while busy", "start")
+	}
+	busy, maintenance = false, true
+	if sm.SendEvent("start") {
+		t.Errorf("Expected event %q not to fire a transition during maintenance", "start")
+	}
+
+	// Check the transition fires once the combined guards fail
+	maintenance = false
+	if !sm.SendEvent("start") {
+		t.Errorf("Expected event %q to fire a transition", "start")
+	}
+	if sm.CurrentState != &working {
+		t.Errorf("Expected current state to be %v, got %v", &working, sm.CurrentState)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	off := State{}
+	on := State{}
+
+	transitions := []Transition{
+		{CurrentState: &off, EventName: "toggle", NextState: &on, Debounce: time.Second},
+		{CurrentState: &on, EventName: "toggle", NextState: &off},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&off, []State{off, on}, transitions, WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	sm.SendEvent("toggle")
+	sm.SendEvent("toggle")
+
+	// Check a rapid second firing is debounced
+	clock.Advance(500 * time.Millisecond)
+	if sm.SendEvent("toggle") {
+		t.Errorf("Expected event %q to be debounced", "toggle")
+	}
+	if sm.CurrentState != &off {
+		t.Errorf("Expected current state to be %v, got %v", &off, sm.CurrentState)
+	}
+
+	// Check it is accepted once the window elapsed
+	clock.Advance(500 * time.Millisecond)
+	if !sm.SendEvent("toggle") {
+		t.Errorf("Expected event %q to fire a transition", "toggle")
+	}
+	if sm.CurrentState != &on {
+		t.Errorf("Expected current state to be %v, got %v", &on, sm.CurrentState)
+	}
+}
+
+func TestCurrentStates(t *testing.T) {
+	resetExecutedActions()
+
+	editing := State{Exit: []Action{recordAction("Editing Exit")}}
+	previewing := State{Exit: []Action{recordAction("Previewing Exit")}}
+	closed := State{Entry: []Action{recordAction("Closed Entry")}}
+
+	transitions := []Transition{
+		{CurrentStates: []*State{&editing, &previewing}, EventName: "close", NextState: &closed},
+		{CurrentState: &editing, EventName: "preview", NextState: &previewing},
+		{CurrentState: &closed, EventName: "open", NextState: &editing},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&editing, []State{editing, previewing, closed}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the transition fires from the first source
+	sm.SendEvent("close")
+	expectedActions := []string{"Editing Exit", "Closed Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check the transition fires from the second source
+	sm.SendEvent("open")
+	sm.SendEvent("preview")
+	resetExecutedActions()
+	sm.SendEvent("close")
+	expectedActions = []string{"Previewing Exit", "Closed Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+	if sm.CurrentState != &closed {
+		t.Errorf("Expected current state to be %v, got %v", &closed, sm.CurrentState)
+	}
+}
+
+func TestLock(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Handle: []Action{recordAction("State 1 Handle")}}
+	state2 := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "go", NextState: &state2},
+		{CurrentState: &state2, EventName: "back", NextState: &state1},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check every call is rejected while locked
+	sm.Lock()
+	if sm.SendEvent("go") {
+		t.Errorf("Expected event %q to be rejected while locked", "go")
+	}
+	if err := sm.Handle(); !errors.Is(err, ErrMachineLocked) {
+		t.Errorf("Expected error %v, got %v", ErrMachineLocked, err)
+	}
+	if sm.LastHandleOutcome() != Locked {
+		t.Errorf("Expected outcome %v, got %v", Locked, sm.LastHandleOutcome())
+	}
+	if sm.CurrentState != &state1 || len(executedActions) != 0 {
+		t.Errorf("Expected nothing to run while locked, got state %v and actions %v", sm.CurrentState, executedActions)
+	}
+
+	// Check calls are accepted after unlocking
+	sm.Unlock()
+	if !sm.SendEvent("go") {
+		t.Errorf("Expected event %q to fire a transition", "go")
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check Replay and ResumeFromCheckpoint leave a locked machine untouched
+	data, err := sm.Checkpoint()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sm.Lock()
+	resetExecutedActions()
+	if err := sm.Replay([]string{"go"}); !errors.Is(err, ErrMachineLocked) {
+		t.Errorf("Expected error %v, got %v", ErrMachineLocked, err)
+	}
+	if err := sm.DryReplay([]string{"go"}); !errors.Is(err, ErrMachineLocked) {
+		t.Errorf("Expected error %v, got %v", ErrMachineLocked, err)
+	}
+	if err := sm.ResumeFromCheckpoint(data); !errors.Is(err, ErrMachineLocked) {
+		t.Errorf("Expected error %v, got %v", ErrMachineLocked, err)
+	}
+	if sm.CurrentState != &state2 || len(executedActions) != 0 {
+		t.Errorf("Expected nothing to run while locked, got state %v and actions %v", sm.CurrentState, executedActions)
+	}
+	if count := sm.TransitionCounts()[&sm.transitions[0]]; count != 1 {
+		t.Errorf("Expected the transition count to be kept, got %d", count)
+	}
+}
+
+func TestLockFromAction(t *testing.T) {
+	stateA := State{Name: "a"}
+	stateB := State{Name: "b"}
+	stateC := State{Name: "c"}
+
+	var sm *HierarchicalStateMachine
+	stateB.Entry = []Action{func() {
+		sm.Lock()
+		sm.SendEvent("next")
+	}}
+	transitions := []Transition{
+		{CurrentState: &stateA, EventName: "go", NextState: &stateB},
+		{CurrentState: &stateB, EventName: "next", NextState: &stateC},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&stateA, []State{stateA, stateB, stateC}, transitions, WithReentrancyPolicy(ReentrancyQueue))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the event queued before locking is dropped
+	sm.SendEvent("go")
+	if sm.CurrentState != &stateB {
+		t.Errorf("Expected current state to be %v, got %v", &stateB, sm.CurrentState)
+	}
+	if sm.LastHandleOutcome() != Locked {
+		t.Errorf("Expected outcome %v, got %v", Locked, sm.LastHandleOutcome())
+	}
+}
+
+func TestCloneSubtree(t *testing.T) {
+	resetExecutedActions()
+
+	home := State{Name: "home"}
+	retry := State{Name: "retry", ParentState: &home, Entry: []Action{recordAction("Retry Entry")}}
+	waiting := State{Name: "waiting", ParentState: &retry, Entry: []Action{recordAction("Waiting Entry")}}
+	attempt := State{Name: "attempt", ParentState: &retry}
+	retry.Initial = &waiting
+
+	transitions := []Transition{
+		{CurrentState: &home, EventName: "go", NextState: &retry},
+		{CurrentState: &waiting, EventName: "tick", NextState: &attempt},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&home, []State{home, retry, waiting, attempt}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	root, copies := sm.CloneSubtree(&retry)
+
+	// Check the whole subtree was copied to new pointers
+	if len(copies) != 3 || copies[0] != root {
+		t.Fatalf("Expected the root and its 2 descendants, got %v", copies)
+	}
+	for _, clone := range copies {
+		if clone == &retry || clone == &waiting || clone == &attempt {
+			t.Errorf("Expected new pointers, got an original %q", clone.Name)
+		}
+	}
+	if root.ParentState != nil {
+		t.Errorf("Expected the cloned root to have no parent, got %v", root.ParentState)
+	}
+	if root.Initial == nil || root.Initial == &waiting || root.Initial.ParentState != root {
+		t.Errorf("Expected the cloned initial state to be a child of the cloned root")
+	}
+
+	// Check the copies are independent of the originals
+	root.Entry = append(root.Entry, recordAction("Cloned Entry"))
+	root.Initial.Name = "cloned waiting"
+	if len(retry.Entry) != 1 || waiting.Name != "waiting" {
+		t.Errorf("Expected the originals to be unchanged")
+	}
+	sm.SendEvent("go")
+	expectedActions := []string{"Retry Entry", "Waiting Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestActionsWithDepth(t *testing.T) {
+	region1 := State{Name: "region1"}
+	composite1 := State{Name: "composite1", ParentState: &region1}
+	state1 := State{Name: "state1", ParentState: &composite1}
+	state2 := State{Name: "state2", ParentState: &composite1}
+	region2 := State{Name: "region2"}
+
+	var crossed []int
+	record := func(crossedLevels int) { crossed = append(crossed, crossedLevels) }
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "sibling", NextState: &state2, ActionsWithDepth: []func(int){record}},
+		{CurrentState: &state2, EventName: "away", NextState: &region2, ActionsWithDepth: []func(int){record}},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{region1, composite1, state1, state2, region2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check an intra-composite transition crosses no level and a cross-region one crosses two
+	sm.SendEvent("sibling")
+	sm.SendEvent("away")
+	expected := []int{0, 2}
+	if !reflect.DeepEqual(crossed, expected) {
+		t.Errorf("Expected crossed levels %v, got %v", expected, crossed)
+	}
+}
+
+// Returns a machine without composite states whose actions do nothing, for allocation checks
+func newFlatMachine(tb testing.TB) *HierarchicalStateMachine {
+	action := func() {}
+	idle := State{Name: "idle", Entry: []Action{action}, Exit: []Action{action}}
+	busy := State{Name: "busy", Entry: []Action{action}, Exit: []Action{action}}
+
+	transitions := []Transition{
+		{CurrentState: &idle, Event: func() bool { return true }, Actions: []Action{action}, NextState: &busy},
+		{CurrentState: &busy, EventName: "tick", Actions: []Action{action}, NextState: &busy},
+		{CurrentState: &busy, Event: func() bool { return true }, Actions: []Action{action}, NextState: &idle},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&idle, []State{idle, busy}, transitions)
+	if err != nil {
+		tb.Fatalf("failed to initialize state machine: %v", err)
+	}
+	return sm
+}
+
+func TestFlatHandleAllocations(t *testing.T) {
+	sm := newFlatMachine(t)
+
+	// Check a flat machine handles without allocating
+	allocs := testing.AllocsPerRun(100, func() {
+		HandleStateMachine(sm)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations, got %v", allocs)
+	}
+}
+
+func BenchmarkHandleFlat(b *testing.B) {
+	sm := newFlatMachine(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		HandleStateMachine(sm)
+	}
+}
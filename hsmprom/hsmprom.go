@@ -0,0 +1,81 @@
+// Package hsmprom exposes the internal counters of a HierarchicalStateMachine as Prometheus
+// collectors. It lives in its own package so the core library does not depend on Prometheus.
+package hsmprom
+
+import (
+	hsm "github.com/coalstevens/hierarchicalStateMachine"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type collector struct {
+	sm           *hsm.HierarchicalStateMachine
+	transitions  *prometheus.Desc
+	currentState *prometheus.Desc
+	timeInState  *prometheus.Desc
+}
+
+// RegisterMetrics registers collectors for transition counts, the current state and the time
+// spent in it. Values are read from the machine on every scrape.
+func RegisterMetrics(sm *hsm.HierarchicalStateMachine, reg prometheus.Registerer, namespace string) error {
+	return reg.Register(newCollector(sm, namespace))
+}
+
+func newCollector(sm *hsm.HierarchicalStateMachine, namespace string) *collector {
+	return &collector{
+		sm: sm,
+		transitions: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "transitions_total"),
+			"Number of times each transition has fired.",
+			[]string{"from", "to"}, nil),
+		currentState: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "current_state"),
+			"1 for the state the machine is currently in, 0 otherwise.",
+			[]string{"state"}, nil),
+		timeInState: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "time_in_state_seconds"),
+			"Seconds spent in the current state.",
+			nil, nil),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.transitions
+	ch <- c.currentState
+	ch <- c.timeInState
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	snapshot := c.sm.MetricsSnapshot()
+
+	// Label values must be unique, so transitions between identically named states are summed
+	type edge struct{ from, to string }
+	counts := map[edge]int{}
+	for transition, count := range snapshot.TransitionCounts {
+		counts[edge{stateLabel(transition.CurrentState), stateLabel(transition.NextState)}] += count
+	}
+	for e, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.transitions, prometheus.CounterValue, float64(count), e.from, e.to)
+	}
+
+	active := map[string]float64{}
+	for _, state := range snapshot.States {
+		name := stateLabel(state)
+		if state == snapshot.CurrentState {
+			active[name] = 1
+		} else if _, ok := active[name]; !ok {
+			active[name] = 0
+		}
+	}
+	for name, value := range active {
+		ch <- prometheus.MustNewConstMetric(c.currentState, prometheus.GaugeValue, value, name)
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.timeInState, prometheus.GaugeValue, snapshot.TimeInState.Seconds())
+}
+
+func stateLabel(state *hsm.State) string {
+	if state == nil {
+		return ""
+	}
+	return string(state.Name)
+}
@@ -0,0 +1,72 @@
+package hsmprom
+
+import (
+	"testing"
+
+	hsm "github.com/coalstevens/hierarchicalStateMachine"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	state1 := hsm.State{Name: "state1"}
+	state2 := hsm.State{Name: "state2"}
+
+	transitions := []hsm.Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := hsm.NewHierarchicalStateMachine(&state1, []hsm.State{state1, state2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	if err := RegisterMetrics(sm, reg, "hsm"); err != nil {
+		t.Fatalf("failed to register metrics: %v", err)
+	}
+
+	// Check the expected metric families are registered
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, expected := range []string{"hsm_transitions_total", "hsm_current_state", "hsm_time_in_state_seconds"} {
+		if !names[expected] {
+			t.Errorf("Expected metric family %s to be registered, got %v", expected, names)
+		}
+	}
+
+	hsm.HandleStateMachine(sm) // Transition from State 1 to State 2
+
+	// Check the metrics reflect the transition
+	families, err = reg.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		switch family.GetName() {
+		case "hsm_transitions_total":
+			if value := family.GetMetric()[0].GetCounter().GetValue(); value != 1 {
+				t.Errorf("Expected 1 transition, got %v", value)
+			}
+		case "hsm_current_state":
+			for _, metric := range family.GetMetric() {
+				expected := 0.0
+				if metric.GetLabel()[0].GetValue() == "state2" {
+					expected = 1
+				}
+				if value := metric.GetGauge().GetValue(); value != expected {
+					t.Errorf("Expected gauge for %s to be %v, got %v", metric.GetLabel()[0].GetValue(), expected, value)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Package hsmtest provides assertions for tests of code built on hierarchicalStateMachine
+package hsmtest
+
+import (
+	"testing"
+
+	hsm "github.com/coalstevens/hierarchicalStateMachine"
+)
+
+// AssertState fails the test if the current state of sm is not named name. The failure message
+// includes the full path of the actual state.
+func AssertState(t testing.TB, sm *hsm.HierarchicalStateMachine, name hsm.StateName) {
+	t.Helper()
+	if sm.CurrentState != nil && sm.CurrentState.Name == name {
+		return
+	}
+	t.Errorf("Expected current state to be %q, got %q", name, sm.StatePathString())
+}
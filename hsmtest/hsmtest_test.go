@@ -0,0 +1,50 @@
+package hsmtest
+
+import (
+	"fmt"
+	"testing"
+
+	hsm "github.com/coalstevens/hierarchicalStateMachine"
+)
+
+// fakeTB records failures instead of failing the real test
+type fakeTB struct {
+	testing.TB
+	failed  bool
+	message string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.failed = true
+	f.message = fmt.Sprintf(format, args...)
+}
+
+func TestAssertState(t *testing.T) {
+	parentState := hsm.State{Name: "parent"}
+	state1 := hsm.State{Name: "state1", ParentState: &parentState}
+
+	sm, err := hsm.NewHierarchicalStateMachine(&state1, []hsm.State{state1, parentState}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the passing case
+	tb := &fakeTB{}
+	AssertState(tb, sm, "state1")
+	if tb.failed {
+		t.Errorf("Expected assertion to pass, got %q", tb.message)
+	}
+
+	// Check the failing case reports the actual state path
+	tb = &fakeTB{}
+	AssertState(tb, sm, "state2")
+	if !tb.failed {
+		t.Fatalf("Expected assertion to fail")
+	}
+	expected := `Expected current state to be "state2", got "parent/state1"`
+	if tb.message != expected {
+		t.Errorf("Expected message %q, got %q", expected, tb.message)
+	}
+}
@@ -0,0 +1,75 @@
+package hierarchicalStateMachine
+
+import "fmt"
+
+// DefaultLifecycleBuffer is the capacity of the Events channel unless set with WithLifecycleBuffer
+const DefaultLifecycleBuffer = 64
+
+// LifecycleKind is what a LifecycleEvent reports
+type LifecycleKind int
+
+const (
+	LifecycleEnter        LifecycleKind = iota // A state was entered, after its Entry actions
+	LifecycleExit                              // A state was exited, after its Exit actions
+	LifecycleTransition                        // A transition settled in State
+	LifecycleGuardBlocked                      // The event matched transitions but their guards failed
+	LifecycleUnhandled                         // No transition matched the event
+)
+
+func (k LifecycleKind) String() string {
+	switch k {
+	case LifecycleEnter:
+		return "Enter"
+	case LifecycleExit:
+		return "Exit"
+	case LifecycleTransition:
+		return "Transition"
+	case LifecycleGuardBlocked:
+		return "GuardBlocked"
+	case LifecycleUnhandled:
+		return "Unhandled"
+	}
+	return fmt.Sprintf("LifecycleKind(%d)", int(k))
+}
+
+// LifecycleEvent is one step of the machine's lifecycle. State is the state entered, exited or
+// settled in, or the current state for blocked and unhandled events. Transition is only set for
+// LifecycleTransition, and Event is the dispatched event name, empty for polls.
+type LifecycleEvent struct {
+	Kind       LifecycleKind
+	State      *State
+	Transition *Transition
+	Event      string
+}
+
+// Events returns a channel of the machine's lifecycle events as they happen, from the first call
+// on. A slow consumer never blocks the machine: events that don't fit in the buffer are dropped
+// and counted, see DroppedEvents. The channel is never closed. Call Events before handling the
+// machine on another goroutine.
+func (sm *HierarchicalStateMachine) Events() <-chan LifecycleEvent {
+	if sm.lifecycle == nil {
+		sm.lifecycle = make(chan LifecycleEvent, sm.lifecycleBuffer)
+	}
+	return sm.lifecycle
+}
+
+// DroppedEvents returns how many lifecycle events didn't fit in the Events buffer. It is safe to
+// call while another goroutine handles the machine.
+func (sm *HierarchicalStateMachine) DroppedEvents() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.lifecycleDropped
+}
+
+func (sm *HierarchicalStateMachine) emit(event LifecycleEvent) {
+	if sm.lifecycle == nil || sm.dryReplay {
+		return
+	}
+	select {
+	case sm.lifecycle <- event:
+	default:
+		sm.mu.Lock()
+		sm.lifecycleDropped++
+		sm.mu.Unlock()
+	}
+}
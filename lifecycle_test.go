@@ -0,0 +1,81 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Returns the lifecycle events waiting in the channel
+func drainEvents(events <-chan LifecycleEvent) []LifecycleEvent {
+	var drained []LifecycleEvent
+	for {
+		select {
+		case event := <-events:
+			drained = append(drained, event)
+		default:
+			return drained
+		}
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	allowed := false
+	parent := State{Name: "parent"}
+	child := State{Name: "child", ParentState: &parent}
+	target := State{Name: "target"}
+
+	transitions := []Transition{
+		{CurrentState: &child, EventName: "go", Guards: []Predicate{func() bool { return allowed }}, NextState: &target},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&child, []State{parent, child, target}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	events := sm.Events()
+
+	// Check blocked and unhandled events are reported
+	sm.SendEvent("go")
+	sm.SendEvent("unknown")
+	expected := []LifecycleEvent{
+		{Kind: LifecycleGuardBlocked, State: &child, Event: "go"},
+		{Kind: LifecycleUnhandled, State: &child, Event: "unknown"},
+	}
+	if got := drainEvents(events); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected events %v, got %v", expected, got)
+	}
+
+	// Check a transition reports its exits, entries and the transition in order
+	allowed = true
+	sm.SendEvent("go")
+	expected = []LifecycleEvent{
+		{Kind: LifecycleExit, State: &child},
+		{Kind: LifecycleExit, State: &parent},
+		{Kind: LifecycleEnter, State: &target},
+		{Kind: LifecycleTransition, State: &target, Transition: &sm.transitions[0]},
+	}
+	if got := drainEvents(events); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected events %v, got %v", expected, got)
+	}
+}
+
+func TestLifecycleEventsDropped(t *testing.T) {
+	state1 := State{}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1}, nil, WithLifecycleBuffer(2))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	events := sm.Events()
+
+	// Check events beyond the buffer are dropped and counted instead of blocking
+	for i := 0; i < 5; i++ {
+		sm.SendEvent("unknown")
+	}
+	if got := len(drainEvents(events)); got != 2 {
+		t.Errorf("Expected 2 buffered events, got %d", got)
+	}
+	if sm.DroppedEvents() != 3 {
+		t.Errorf("Expected 3 dropped events, got %d", sm.DroppedEvents())
+	}
+}
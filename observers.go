@@ -0,0 +1,24 @@
+package hierarchicalStateMachine
+
+// AddObserver registers fn to be told about every change of the current state, after the new
+// state's Entry actions and before the transition's OnComplete. Under WithCoalescedObservers it
+// is instead told once per dispatch, with the state the dispatch started from and the one the
+// machine settled in, however many transitions ran in between.
+func (sm *HierarchicalStateMachine) AddObserver(fn func(from, to *State)) {
+	sm.observers = append(sm.observers, fn)
+}
+
+// Notifies the observers of a state change now, or marks the dispatch as changed when coalescing
+func (sm *HierarchicalStateMachine) changed(from, to *State) {
+	if sm.coalesceObservers {
+		sm.changedSinceSettle = true
+		return
+	}
+	sm.notifyObservers(from, to)
+}
+
+func (sm *HierarchicalStateMachine) notifyObservers(from, to *State) {
+	for _, observer := range sm.observers {
+		observer(from, to)
+	}
+}
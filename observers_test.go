@@ -0,0 +1,96 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+type observedChange struct {
+	from, to *State
+}
+
+// Returns a machine that chains state1 -> state2 -> state3 -> state4 on a single "go" event
+func newChainedMachine(t *testing.T, opts ...Option) (*HierarchicalStateMachine, []*State) {
+	state1 := &State{Name: "state1"}
+	state2 := &State{Name: "state2"}
+	state3 := &State{Name: "state3"}
+	state4 := &State{Name: "state4"}
+
+	var sm *HierarchicalStateMachine
+	sendNext := func() { sm.SendEvent("next") }
+	transitions := []Transition{
+		{CurrentState: state1, EventName: "go", NextState: state2, OnComplete: sendNext},
+		{CurrentState: state2, EventName: "next", NextState: state3, OnComplete: sendNext},
+		{CurrentState: state3, EventName: "next", NextState: state4},
+	}
+
+	opts = append(opts, WithReentrancyPolicy(ReentrancyQueue))
+	sm, err := NewHierarchicalStateMachine(state1, []State{*state1, *state2, *state3, *state4}, transitions, opts...)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	return sm, []*State{state1, state2, state3, state4}
+}
+
+func TestObservers(t *testing.T) {
+	sm, states := newChainedMachine(t)
+
+	var changes []observedChange
+	sm.AddObserver(func(from, to *State) {
+		changes = append(changes, observedChange{from, to})
+	})
+
+	// Check every transition is observed
+	sm.SendEvent("go")
+	expectedChanges := []observedChange{{states[0], states[1]}, {states[1], states[2]}, {states[2], states[3]}}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("Expected changes %v, got %v", expectedChanges, changes)
+	}
+}
+
+func TestCoalescedObservers(t *testing.T) {
+	sm, states := newChainedMachine(t, WithCoalescedObservers())
+
+	var changes []observedChange
+	sm.AddObserver(func(from, to *State) {
+		changes = append(changes, observedChange{from, to})
+	})
+
+	// Check the chain is observed once with the net change
+	sm.SendEvent("go")
+	expectedChanges := []observedChange{{states[0], states[3]}}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("Expected changes %v, got %v", expectedChanges, changes)
+	}
+
+	// Check a dispatch without a transition is not observed
+	sm.SendEvent("go")
+	if len(changes) != 1 {
+		t.Errorf("Expected 1 change, got %d", len(changes))
+	}
+}
+
+func TestObserversDiscard(t *testing.T) {
+	state1 := State{Name: "state1"}
+	state2 := State{Name: "state2"}
+
+	transitions := []Transition{{CurrentState: &state1, EventName: "go", NextState: &state2}}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithDeferredExecution())
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	var changes []observedChange
+	sm.AddObserver(func(from, to *State) {
+		changes = append(changes, observedChange{from, to})
+	})
+
+	// Check the revert is observed after the discarded transition
+	sm.SendEvent("go")
+	sm.Discard()
+	expectedChanges := []observedChange{{&state1, &state2}, {&state2, &state1}}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("Expected changes %v, got %v", expectedChanges, changes)
+	}
+}
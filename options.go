@@ -0,0 +1,181 @@
+package hierarchicalStateMachine
+
+import "time"
+
+// Option configures a HierarchicalStateMachine at construction
+type Option func(sm *HierarchicalStateMachine)
+
+// WithDeferredExecution buffers every action run by HandleStateMachine instead of running it.
+// The state still changes immediately, so a transition can be computed and then committed with
+// Flush or reverted with Discard. Entry actions of the initial state run at construction as usual.
+func WithDeferredExecution() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.deferredExecution = true
+	}
+}
+
+// WithReentrancyPolicy sets how reentrant HandleStateMachine calls from actions are treated
+func WithReentrancyPolicy(policy ReentrancyPolicy) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.reentrancyPolicy = policy
+	}
+}
+
+// WithDuplicatePolicy sets how transitions sharing a source state and event are resolved
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.duplicatePolicy = policy
+	}
+}
+
+// WithStrictAncestry rejects transitions whose source and target share no common ancestor,
+// unless the transition sets CrossTree. Note that root states in a flat machine are unrelated.
+func WithStrictAncestry() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.strictAncestry = true
+	}
+}
+
+// WithClock replaces the wall clock used for entry timestamps and time-based guards
+func WithClock(clock Clock) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.clock = clock
+	}
+}
+
+// WithAutoComplete posts event whenever a transition settles the machine on a leaf with no
+// outgoing transitions. The event is dispatched once the current dispatch finishes and is matched
+// against transitions from the leaf and then from each of its ancestors, nearest first. A dispatch
+// stops after MaxStates events posted this way, dropping what it queued and returning an error.
+func WithAutoComplete(event string) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.autoCompleteEvent = event
+	}
+}
+
+// WithGuardErrorPolicy sets how errors returned by CheckedGuards are treated
+func WithGuardErrorPolicy(policy GuardErrorPolicy) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.guardErrorPolicy = policy
+	}
+}
+
+// WithErrorState sets the state GuardErrorRoute moves to, exiting the current hierarchy and
+// entering the error state like a transition would
+func WithErrorState(state *State) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.errorState = state
+	}
+}
+
+// WithActivityStopTimeout sets how long exiting a state waits for its DoActivity to return after
+// cancelling it. An activity still running after the timeout is left to finish on its own.
+func WithActivityStopTimeout(d time.Duration) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.activityStopTimeout = d
+	}
+}
+
+// WithPanicPolicy sets how panics in the actions of a phase are handled. RouteToErrorState needs
+// an error state set with WithErrorState.
+func WithPanicPolicy(phase Phase, policy PanicPolicy) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.panicPolicies[phase] = policy
+	}
+}
+
+// WithActionLog records every executed action, see ActionLog. Entry actions of the initial state
+// are recorded too.
+func WithActionLog() Option {
+	return func(sm *HierarchicalStateMachine) {
+		if sm.actionLog == nil {
+			sm.actionLog = &actionLog{cap: DefaultActionLogCap}
+		}
+	}
+}
+
+// WithActionLogCap sets how many entries the action log keeps, enabling it if needed. A cap of
+// zero or less keeps every entry.
+func WithActionLogCap(n int) Option {
+	return func(sm *HierarchicalStateMachine) {
+		WithActionLog()(sm)
+		sm.actionLog.cap = n
+	}
+}
+
+// WithGuardTrace records the result of every Event and guard evaluated by each dispatch, see
+// LastGuardTrace
+func WithGuardTrace() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.tracingGuards = true
+	}
+}
+
+// WithTieBreaker decides between eligible transitions of equal Priority under HighestPriority:
+// aFirst reports whether a fires rather than b. Without one, the transition declared first fires.
+func WithTieBreaker(aFirst func(a, b *Transition) bool) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.tieBreaker = aFirst
+	}
+}
+
+// WithStepMode lets a debugger walk through each handle one action at a time. Handling computes
+// the transition and buffers its actions as WithDeferredExecution does, and each StepAction call
+// runs the next one, so the caller can inspect the machine in between.
+func WithStepMode() Option {
+	return WithDeferredExecution()
+}
+
+// WithCoalescedObservers notifies observers once per settled dispatch, with the net change of
+// state, instead of once per transition. Transitions queued by reentrant calls or WithAutoComplete
+// are part of the dispatch that queued them.
+func WithCoalescedObservers() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.coalesceObservers = true
+	}
+}
+
+// WithGuardPurityCheck is a development aid that catches guards with side effects, which break
+// previews such as ExitSetFor and DryReplay. Every Guards and GuardGroups predicate is evaluated
+// twice and a warning is logged the first time a transition's results differ, see ImpureGuards.
+// It doubles the cost of guards and has no effect under WithGuardTrace.
+func WithGuardPurityCheck() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.checkingPurity = true
+	}
+}
+
+// WithLifecycleBuffer sets the capacity of the channel returned by Events
+func WithLifecycleBuffer(n int) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.lifecycleBuffer = n
+	}
+}
+
+// WithExecutor routes every action through executor instead of running it inline, including
+// actions run later by Flush or StepAction
+func WithExecutor(executor ActionExecutor) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.executor = executor
+	}
+}
+
+// WithEventPropagation sets how far named events unhandled by the current state reach up the
+// hierarchy. Under PropagationBubbling the current state's transitions are tried first, then its
+// parent's, then its grandparent's, and the first eligible one fires.
+func WithEventPropagation(mode EventPropagation) Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.propagation = mode
+	}
+}
+
+// WithTransactionalRTC makes every dispatch all or nothing: when one of the CheckedActions of a
+// transition fails, including one chained by an OnEntry transition or a queued dispatch, the
+// machine returns to the state it was in when the dispatch started, without running any Exit or
+// Entry actions, drops the queued dispatches and returns the error. The transition counts,
+// DispatchStats and debounce times are reverted too, but actions that already ran are not undone.
+func WithTransactionalRTC() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.transactionalRTC = true
+	}
+}
@@ -0,0 +1,104 @@
+package hierarchicalStateMachine
+
+import (
+	"fmt"
+	"log"
+)
+
+// Phase is the part of a handle an action runs in
+type Phase int
+
+const (
+	PhaseEntry      Phase = iota // Entry actions and starting DoActivity
+	PhaseExit                    // Exit actions and stopping DoActivity
+	PhaseHandle                  // Handle actions
+	PhaseTransition              // Transition Actions and OnComplete
+	phaseCount
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseEntry:
+		return "entry"
+	case PhaseExit:
+		return "exit"
+	case PhaseHandle:
+		return "handle"
+	case PhaseTransition:
+		return "transition"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// PanicPolicy decides what happens when an action panics
+type PanicPolicy int
+
+const (
+	Propagate         PanicPolicy = iota // Let the panic escape the handle (default)
+	Recover                              // Log the panic and carry on with the next action
+	RouteToErrorState                    // Abandon the handle and move to the state set by WithErrorState
+)
+
+// routedPanic unwinds the handle after an action panicked under RouteToErrorState
+type routedPanic struct {
+	phase Phase
+	value interface{}
+}
+
+// Returns the action wrapped to apply the phase's PanicPolicy
+func (sm *HierarchicalStateMachine) isolate(phase Phase, action Action) Action {
+	policy := sm.panicPolicies[phase]
+	if policy == Propagate {
+		return action
+	}
+	return func() {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if policy == RouteToErrorState && !sm.routing {
+				panic(routedPanic{phase: phase, value: v})
+			}
+			log.Printf("hierarchicalStateMachine: recovered panic in %v action: %v", phase, v)
+		}()
+		action()
+	}
+}
+
+// Moves to the error state for a routed panic and panics again with anything else. The
+// interrupted transition is abandoned, so the Exit actions it had not run yet are skipped.
+func (sm *HierarchicalStateMachine) routePanic(v interface{}) {
+	routed, ok := v.(routedPanic)
+	if !ok {
+		panic(v)
+	}
+	log.Printf("hierarchicalStateMachine: panic in %v action, routing to the error state: %v", routed.phase, routed.value)
+
+	sm.routing = true
+	defer func() { sm.routing = false }()
+	sm.enterErrorState(true)
+	sm.stopActivitiesOutside(sm.CurrentState)
+	sm.lastOutcome = Panicked
+}
+
+// Runs an entry made outside a dispatch, such as the initial one, routing its panics as a
+// dispatch would
+func (sm *HierarchicalStateMachine) routingPanics(enter func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			sm.routePanic(v)
+		}
+	}()
+	enter()
+}
+
+// Stops the activities of every state but the current one and its ancestors, such as those the
+// abandoned transition had already entered
+func (sm *HierarchicalStateMachine) stopActivitiesOutside(current *State) {
+	for state := range sm.activities {
+		if state != current && !isDescendant(current, state) {
+			sm.stopActivity(state)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package hierarchicalStateMachine
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPanicPolicyRecover(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{
+		Exit: []Action{
+			func() { panic("cleanup failed") },
+			recordAction("State 1 Exit"),
+		},
+	}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+
+	transitions := []Transition{{CurrentState: &state1, NextState: &state2}}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithPanicPolicy(PhaseExit, Recover))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the panicking Exit action is swallowed and the transition completes
+	HandleStateMachine(sm)
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+	expectedActions := []string{"State 1 Exit", "State 2 Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+}
+
+func TestPanicPolicyRouteToErrorState(t *testing.T) {
+	resetExecutedActions()
+
+	state1 := State{Exit: []Action{recordAction("State 1 Exit")}}
+	state2 := State{Entry: []Action{recordAction("State 2 Entry")}}
+	failed := State{Entry: []Action{recordAction("Failed Entry")}}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Actions:      []Action{func() { panic("transfer failed") }},
+			NextState:    &state2,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, failed}, transitions,
+		WithPanicPolicy(PhaseTransition, RouteToErrorState), WithErrorState(&failed))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the panicking transition action abandons the transition for the error state
+	HandleStateMachine(sm)
+	if sm.CurrentState != &failed {
+		t.Errorf("Expected current state to be %v, got %v", &failed, sm.CurrentState)
+	}
+	if sm.LastHandleOutcome() != Panicked {
+		t.Errorf("Expected outcome %v, got %v", Panicked, sm.LastHandleOutcome())
+	}
+	expectedActions := []string{"State 1 Exit", "Failed Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check the default policy still propagates
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected the entry panic to propagate")
+		}
+	}()
+	state3 := State{Entry: []Action{func() { panic("boom") }}}
+	NewHierarchicalStateMachine(&state3, []State{state3}, nil)
+}
+
+func TestPanicPolicyRouteInitialEntry(t *testing.T) {
+	state1 := State{Entry: []Action{func() { panic("boom") }}}
+	state2 := State{}
+	failed := State{}
+
+	transitions := []Transition{
+		{CurrentState: &state1, EventName: "go", NextState: &state2},
+		{CurrentState: &failed, EventName: "go", NextState: &state2},
+	}
+
+	// Check a panicking initial Entry action routes to the error state instead of escaping
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, failed}, transitions,
+		WithPanicPolicy(PhaseEntry, RouteToErrorState), WithErrorState(&failed))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if sm.CurrentState != &failed {
+		t.Errorf("Expected current state to be %v, got %v", &failed, sm.CurrentState)
+	}
+
+	// Check the same holds for the initial entry of Replay
+	if err := sm.Replay([]string{"go"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+
+	// Check the same holds for the first entry of a parsed machine
+	parsed, states, err := Parse("A -> B : go")
+	if err != nil {
+		t.Fatalf("failed to parse state chart: %v", err)
+	}
+	states["A"].Entry = []Action{func() { panic("boom") }}
+	WithPanicPolicy(PhaseEntry, RouteToErrorState)(parsed)
+	WithErrorState(states["B"])(parsed)
+	parsed.SendEvent("unknown")
+	if parsed.CurrentState != states["B"] {
+		t.Errorf("Expected current state to be %v, got %v", states["B"], parsed.CurrentState)
+	}
+}
+
+func TestPanicPolicyRouteStopsActivities(t *testing.T) {
+	cancelled := make(chan struct{})
+	state1 := State{
+		DoActivity: func(ctx context.Context) {
+			<-ctx.Done()
+			close(cancelled)
+		},
+		Handle: []Action{func() { panic("boom") }},
+	}
+	failed := State{}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, failed}, nil,
+		WithPanicPolicy(PhaseHandle, RouteToErrorState), WithErrorState(&failed))
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the state abandoned for the error state has its activity stopped
+	HandleStateMachine(sm)
+	if sm.CurrentState != &failed {
+		t.Errorf("Expected current state to be %v, got %v", &failed, sm.CurrentState)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the activity to be cancelled")
+	}
+	if len(sm.activities) != 0 {
+		t.Errorf("Expected no running activities, got %d", len(sm.activities))
+	}
+}
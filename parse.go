@@ -0,0 +1,181 @@
+package hierarchicalStateMachine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var transitionLine = regexp.MustCompile(`^(\w+)\s*->\s*(\w+)\s*(?::\s*(\w+))?\s*(?:\[\s*(\w+)\s*\])?$`)
+
+// Parse builds a machine from a line-oriented state-chart description, for quick prototypes and
+// tests. Each line is either a declaration or a transition, and # starts a comment:
+//
+//	state Parent { A B }
+//	A -> B : event [guard]
+//
+// A and B are children of Parent, the first child being its initial state. The event and guard
+// of a transition are optional. State blocks may span lines and nest, and states only mentioned
+// in transitions are roots. The first root state is the initial state. Transitions without an
+// event are polled by HandleStateMachine. Guards are stubs that fail until a predicate is bound to
+// their name with BindGuard or BindRegistry, and actions are added through the returned states.
+// The machine enters its initial state on its first dispatch rather than in Parse, so the Entry
+// actions added before then run for it too. Until then CurrentState is the initial root state.
+func Parse(src string) (*HierarchicalStateMachine, map[StateName]*State, error) {
+	var order []StateName
+	parents := map[StateName]StateName{}
+	children := map[StateName][]StateName{}
+	declare := func(name StateName) {
+		if _, ok := parents[name]; !ok {
+			parents[name] = ""
+			order = append(order, name)
+		}
+	}
+
+	type parsedTransition struct {
+		from, to     StateName
+		event, guard string
+	}
+	var transitions []parsedTransition
+	var blocks []StateName
+
+	for i, line := range strings.Split(src, "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.Contains(line, "->") {
+			match := transitionLine.FindStringSubmatch(line)
+			if match == nil {
+				return nil, nil, fmt.Errorf("line %d: malformed transition %q", i+1, line)
+			}
+			from, to := StateName(match[1]), StateName(match[2])
+			declare(from)
+			declare(to)
+			transitions = append(transitions, parsedTransition{from: from, to: to, event: match[3], guard: match[4]})
+			continue
+		}
+
+		tokens := strings.Fields(strings.NewReplacer("{", " { ", "}", " } ").Replace(line))
+		for j := 0; j < len(tokens); j++ {
+			switch token := tokens[j]; token {
+			case "}":
+				if len(blocks) == 0 {
+					return nil, nil, fmt.Errorf("line %d: unexpected }", i+1)
+				}
+				blocks = blocks[:len(blocks)-1]
+			case "state":
+				if j+2 >= len(tokens) || tokens[j+2] != "{" {
+					return nil, nil, fmt.Errorf("line %d: expected state <name> {", i+1)
+				}
+				name := StateName(tokens[j+1])
+				if err := declareChild(name, blocks, parents, children, declare); err != nil {
+					return nil, nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+				blocks = append(blocks, name)
+				j += 2
+			case "{":
+				return nil, nil, fmt.Errorf("line %d: unexpected {", i+1)
+			default:
+				if err := declareChild(StateName(token), blocks, parents, children, declare); err != nil {
+					return nil, nil, fmt.Errorf("line %d: %v", i+1, err)
+				}
+			}
+		}
+	}
+	if len(blocks) > 0 {
+		return nil, nil, fmt.Errorf("state %q is missing its closing }", blocks[len(blocks)-1])
+	}
+	if len(order) == 0 {
+		return nil, nil, fmt.Errorf("no states declared")
+	}
+
+	states := make(map[StateName]*State, len(order))
+	for _, name := range order {
+		states[name] = &State{Name: name}
+	}
+	var initial *State
+	for _, name := range order {
+		state := states[name]
+		if parent := parents[name]; parent != "" {
+			state.ParentState = states[parent]
+		} else if initial == nil {
+			initial = state
+		}
+		if kids := children[name]; len(kids) > 0 {
+			state.Initial = states[kids[0]]
+		}
+	}
+
+	// Guards are resolved on use, since the machine doesn't exist yet
+	var sm *HierarchicalStateMachine
+	wired := make([]Transition, len(transitions))
+	for i, parsed := range transitions {
+		wired[i] = Transition{CurrentState: states[parsed.from], EventName: parsed.event, NextState: states[parsed.to]}
+		if guard := parsed.guard; guard != "" {
+			wired[i].Guards = []Predicate{func() bool {
+				if sm.registry == nil {
+					return false
+				}
+				bound, err := sm.registry.Guard(guard)
+				return err == nil && bound()
+			}}
+		}
+	}
+
+	values := make([]State, 0, len(order))
+	for _, name := range order {
+		values = append(values, *states[name])
+	}
+	sm, err := NewHierarchicalStateMachine(initial, values, wired, withoutInitialEntry())
+	if err != nil {
+		return nil, nil, err
+	}
+	return sm, states, nil
+}
+
+// Leaves entering the initial state to the first dispatch
+func withoutInitialEntry() Option {
+	return func(sm *HierarchicalStateMachine) {
+		sm.unentered = true
+	}
+}
+
+// Declares the state as a child of the innermost open block, or as a root outside any block
+func declareChild(name StateName, blocks []StateName, parents map[StateName]StateName, children map[StateName][]StateName, declare func(StateName)) error {
+	declare(name)
+	if len(blocks) == 0 {
+		return nil
+	}
+	parent := blocks[len(blocks)-1]
+	if name == parent {
+		return fmt.Errorf("state %q cannot contain itself", name)
+	}
+	if existing := parents[name]; existing != "" && existing != parent {
+		return fmt.Errorf("state %q declared in both %q and %q", name, existing, parent)
+	}
+	if parents[name] == "" {
+		parents[name] = parent
+		children[parent] = append(children[parent], name)
+	}
+	return nil
+}
+
+// BindGuard sets the predicate used by the guards named name in a parsed machine, registering it
+// in the machine's Registry
+func (sm *HierarchicalStateMachine) BindGuard(name string, guard Predicate) {
+	if sm.registry == nil {
+		sm.registry = &Registry{}
+	}
+	sm.registry.RegisterGuard(name, guard)
+}
+
+// BindRegistry resolves the guards of a parsed machine through r, replacing the guards bound so
+// far. Guards registered in r later are picked up on their next evaluation.
+func (sm *HierarchicalStateMachine) BindRegistry(r *Registry) {
+	sm.registry = r
+}
@@ -0,0 +1,148 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	src := `
+		# Order workflow
+		state Active {
+			Idle Running
+		}
+		Idle -> Running : start
+		Running -> Done : finish [canFinish]
+		Done -> Active
+	`
+
+	sm, states, err := Parse(src)
+	if err != nil {
+		t.Fatalf("failed to parse state chart: %v", err)
+	}
+
+	// Check the states and their hierarchy
+	if len(states) != 4 {
+		t.Fatalf("Expected 4 states, got %d", len(states))
+	}
+	active, idle, running, done := states["Active"], states["Idle"], states["Running"], states["Done"]
+	if idle.ParentState != active || running.ParentState != active || done.ParentState != nil {
+		t.Errorf("Expected Idle and Running under Active and Done at the root")
+	}
+	if active.Initial != idle {
+		t.Errorf("Expected the first child to be the initial state of Active, got %v", active.Initial)
+	}
+	// Check the initial state is entered on the first dispatch, with the actions added after parsing
+	resetExecutedActions()
+	active.Entry = []Action{recordAction("Active Entry")}
+	idle.Entry = []Action{recordAction("Idle Entry")}
+	sm.SendEvent("unknown")
+	expectedActions := []string{"Active Entry", "Idle Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+	if sm.CurrentState != idle {
+		t.Errorf("Expected current state to be %v, got %v", idle, sm.CurrentState)
+	}
+
+	// Check the transitions
+	type edge struct {
+		from, to StateName
+		event    string
+		guarded  bool
+	}
+	var edges []edge
+	for _, transition := range sm.transitions {
+		edges = append(edges, edge{transition.CurrentState.Name, transition.NextState.Name, transition.EventName, len(transition.Guards) > 0})
+	}
+	expected := []edge{
+		{"Idle", "Running", "start", false},
+		{"Running", "Done", "finish", true},
+		{"Done", "Active", "", false},
+	}
+	if !reflect.DeepEqual(edges, expected) {
+		t.Errorf("Expected transitions %v, got %v", expected, edges)
+	}
+
+	// Check a guard stub fails until it is bound
+	sm.SendEvent("start")
+	if sm.SendEvent("finish") {
+		t.Errorf("Expected unbound guard to block the transition")
+	}
+	sm.BindGuard("canFinish", func() bool { return true })
+	if !sm.SendEvent("finish") || sm.CurrentState != done {
+		t.Errorf("Expected bound guard to allow the transition to %v, got %v", done, sm.CurrentState)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"A -> ",
+		"state A { B",
+		"}",
+		"state A { B }\nstate C { B }",
+	} {
+		if _, _, err := Parse(src); err == nil {
+			t.Errorf("Expected an error parsing %q", src)
+		}
+	}
+}
+
+func TestParseInitialEntry(t *testing.T) {
+	src := "A -> B : go"
+	parse := func() (*HierarchicalStateMachine, map[StateName]*State) {
+		sm, states, err := Parse(src)
+		if err != nil {
+			t.Fatalf("failed to parse state chart: %v", err)
+		}
+		states["A"].Entry = []Action{recordAction("A Entry")}
+		states["B"].Entry = []Action{recordAction("B Entry")}
+		return sm, states
+	}
+
+	// Check Replay enters the initial state once
+	resetExecutedActions()
+	sm, states := parse()
+	if err := sm.Replay([]string{"go"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sm.SendEvent("unknown")
+	expectedActions := []string{"A Entry", "B Entry"}
+	if !reflect.DeepEqual(executedActions, expectedActions) {
+		t.Errorf("expected actions %v, got %v", expectedActions, executedActions)
+	}
+
+	// Check a resumed machine runs no Entry actions on its next dispatch
+	data, err := sm.Checkpoint()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resumed, states := parse()
+	if err := resumed.ResumeFromCheckpoint(data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resetExecutedActions()
+	resumed.SendEvent("unknown")
+	if len(executedActions) != 0 {
+		t.Errorf("Expected no actions, got %v", executedActions)
+	}
+	if resumed.CurrentState != states["B"] {
+		t.Errorf("Expected current state to be %v, got %v", states["B"], resumed.CurrentState)
+	}
+
+	// Check dispatching from the initial Entry actions is reentrant
+	sm, states = parse()
+	states["A"].Entry = []Action{func() { sm.SendEvent("go") }}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a reentrant dispatch to panic")
+			}
+		}()
+		sm.SendEvent("unknown")
+	}()
+	if sm.CurrentState == states["B"] {
+		t.Errorf("Expected the reentrant dispatch not to move the machine to %v", states["B"])
+	}
+}
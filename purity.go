@@ -0,0 +1,60 @@
+package hierarchicalStateMachine
+
+import "log"
+
+// ImpureGuards returns the transitions whose Guards or GuardGroups returned different results
+// when evaluated twice in a row under WithGuardPurityCheck, in the order they were first caught
+func (sm *HierarchicalStateMachine) ImpureGuards() []*Transition {
+	return append([]*Transition(nil), sm.impureGuards...)
+}
+
+// Like guardsPassed, but runs every predicate twice and flags the transition when the results
+// differ. The first result is used.
+func (sm *HierarchicalStateMachine) pureGuardsPassed(transition *Transition) bool {
+	return sm.pureCombinedGuardsPass(transition) != transition.InvertGuards
+}
+
+func (sm *HierarchicalStateMachine) pureCombinedGuardsPass(transition *Transition) bool {
+	if !sm.purePredicatesPass(transition, transition.Guards) {
+		return false
+	}
+	if len(transition.GuardGroups) == 0 {
+		return true
+	}
+	for _, group := range transition.GuardGroups {
+		if sm.purePredicatesPass(transition, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *HierarchicalStateMachine) purePredicatesPass(transition *Transition, predicates []Predicate) bool {
+	for _, predicate := range predicates {
+		passed := predicate()
+		if predicate() != passed {
+			sm.flagImpure(transition)
+		}
+		if !passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (sm *HierarchicalStateMachine) flagImpure(transition *Transition) {
+	if containsTransition(sm.impureGuards, transition) {
+		return
+	}
+	log.Printf("hierarchicalStateMachine: guard on transition from %q to %q returned different results when evaluated twice", stateName(transition.CurrentState), stateName(transition.NextState))
+	sm.impureGuards = append(sm.impureGuards, transition)
+}
+
+func containsTransition(transitions []*Transition, transition *Transition) bool {
+	for _, known := range transitions {
+		if known == transition {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package hierarchicalStateMachine
+
+import "testing"
+
+func TestGuardPurityCheck(t *testing.T) {
+	calls := 0
+	flip := false
+	state1 := State{}
+	state2 := State{}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			EventName:    "impure",
+			Guards: []Predicate{func() bool {
+				calls++
+				flip = !flip
+				return flip
+			}},
+			NextState: &state2,
+		},
+		{CurrentState: &state1, EventName: "pure", Guards: []Predicate{func() bool { return false }}, NextState: &state2},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2}, transitions, WithGuardPurityCheck())
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check a pure guard is not flagged
+	sm.SendEvent("pure")
+	if len(sm.ImpureGuards()) != 0 {
+		t.Errorf("Expected no impure guards, got %v", sm.ImpureGuards())
+	}
+
+	// Check the impure guard is evaluated twice and flagged
+	sm.SendEvent("impure")
+	if calls != 2 {
+		t.Errorf("Expected the guard to be evaluated 2 times, got %d", calls)
+	}
+	impure := sm.ImpureGuards()
+	if len(impure) != 1 || impure[0] != &sm.transitions[0] {
+		t.Errorf("Expected the impure transition to be flagged, got %v", impure)
+	}
+
+	// Check the first result was used
+	if sm.CurrentState != &state2 {
+		t.Errorf("Expected current state to be %v, got %v", &state2, sm.CurrentState)
+	}
+}
@@ -0,0 +1,59 @@
+package hierarchicalStateMachine
+
+import "fmt"
+
+// Registry maps names to the actions, guards and event predicates of config-driven machines, so
+// loaders such as Parse resolve names in one place. The zero value is empty and ready to use.
+type Registry struct {
+	actions map[string]Action
+	guards  map[string]Predicate
+	events  map[string]Predicate
+}
+
+// RegisterAction sets the action resolved for name, replacing any earlier one
+func (r *Registry) RegisterAction(name string, action Action) {
+	if r.actions == nil {
+		r.actions = map[string]Action{}
+	}
+	r.actions[name] = action
+}
+
+// RegisterGuard sets the guard resolved for name, replacing any earlier one
+func (r *Registry) RegisterGuard(name string, guard Predicate) {
+	if r.guards == nil {
+		r.guards = map[string]Predicate{}
+	}
+	r.guards[name] = guard
+}
+
+// RegisterEvent sets the Event predicate resolved for name, replacing any earlier one
+func (r *Registry) RegisterEvent(name string, event Predicate) {
+	if r.events == nil {
+		r.events = map[string]Predicate{}
+	}
+	r.events[name] = event
+}
+
+// Action returns the action registered for name
+func (r *Registry) Action(name string) (Action, error) {
+	if action, ok := r.actions[name]; ok {
+		return action, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", name)
+}
+
+// Guard returns the guard registered for name
+func (r *Registry) Guard(name string) (Predicate, error) {
+	if guard, ok := r.guards[name]; ok {
+		return guard, nil
+	}
+	return nil, fmt.Errorf("unknown guard %q", name)
+}
+
+// Event returns the Event predicate registered for name
+func (r *Registry) Event(name string) (Predicate, error) {
+	if event, ok := r.events[name]; ok {
+		return event, nil
+	}
+	return nil, fmt.Errorf("unknown event %q", name)
+}
@@ -0,0 +1,64 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	resetExecutedActions()
+
+	var r Registry
+	r.RegisterAction("log", recordAction("Logged"))
+	r.RegisterGuard("always", func() bool { return true })
+	r.RegisterEvent("never", func() bool { return false })
+
+	// Check registered names resolve
+	action, err := r.Action("log")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	action()
+	if !reflect.DeepEqual(executedActions, []string{"Logged"}) {
+		t.Errorf("Expected the registered action to run, got %v", executedActions)
+	}
+	if guard, err := r.Guard("always"); err != nil || !guard() {
+		t.Errorf("Expected the registered guard to pass, got error %v", err)
+	}
+	if event, err := r.Event("never"); err != nil || event() {
+		t.Errorf("Expected the registered event not to occur, got error %v", err)
+	}
+
+	// Check unknown names are reported
+	if _, err := r.Action("missing"); err == nil {
+		t.Errorf("Expected an error for an unknown action, got nil")
+	}
+	if _, err := r.Guard("log"); err == nil {
+		t.Errorf("Expected an error for an unknown guard, got nil")
+	}
+	if _, err := r.Event("always"); err == nil {
+		t.Errorf("Expected an error for an unknown event, got nil")
+	}
+}
+
+func TestBindRegistry(t *testing.T) {
+	sm, states, err := Parse("A -> B : go [ready]")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var r Registry
+	sm.BindRegistry(&r)
+
+	// Check the parsed guard resolves through the registry
+	if sm.SendEvent("go") {
+		t.Errorf("Expected the unregistered guard to block %q", "go")
+	}
+	r.RegisterGuard("ready", func() bool { return true })
+	if !sm.SendEvent("go") {
+		t.Errorf("Expected event %q to fire a transition", "go")
+	}
+	if sm.CurrentState != states["B"] {
+		t.Errorf("Expected current state to be %v, got %v", states["B"], sm.CurrentState)
+	}
+}
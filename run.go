@@ -0,0 +1,108 @@
+package hierarchicalStateMachine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// AsyncGuard is a guard that may block, such as on a remote permission check. It should return
+// promptly with ctx.Err() once ctx is done.
+type AsyncGuard func(ctx context.Context) (bool, error)
+
+// ErrAsyncGuardOutsideRun is returned by dispatches outside Run that reach a transition with
+// AsyncGuards, whatever the GuardErrorPolicy
+var ErrAsyncGuardOutsideRun = errors.New("async guards can only be evaluated by Run")
+
+// Run dispatches every event received from events in order, awaiting AsyncGuards with ctx, until
+// ctx is done or events is closed. An empty event polls like HandleStateMachine. It returns the
+// first error a dispatch returns, nil once events is closed, or the context's error. Events
+// rejected by Lock are dropped without stopping the loop. The machine must not be dispatched
+// from another goroutine while Run is running, but Checkpoint and ResumeFromCheckpoint may be
+// called: they pause the loop between two events.
+func (sm *HierarchicalStateMachine) Run(ctx context.Context, events <-chan string) error {
+	loop := &runLoop{calls: make(chan func()), done: make(chan struct{})}
+	sm.mu.Lock()
+	sm.running = loop
+	sm.mu.Unlock()
+	defer func() {
+		sm.mu.Lock()
+		sm.running = nil
+		sm.mu.Unlock()
+		close(loop.done)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case call := <-loop.calls:
+			call()
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := sm.runEvent(ctx, event); err != nil && !errors.Is(err, ErrMachineLocked) {
+				return err
+			}
+		}
+	}
+}
+
+// runLoop lets other goroutines reach a machine driven by Run between two dispatches
+type runLoop struct {
+	calls chan func()
+	done  chan struct{} // Closed once Run returns
+}
+
+// Runs fn on the goroutine of Run between two dispatches while Run drives the machine, or directly
+// otherwise. It must not be called from an action run by Run, which would wait for itself.
+func (sm *HierarchicalStateMachine) quiesced(fn func()) {
+	sm.mu.Lock()
+	loop := sm.running
+	sm.mu.Unlock()
+	if loop == nil {
+		fn()
+		return
+	}
+
+	finished := make(chan struct{})
+	select {
+	case loop.calls <- func() {
+		defer close(finished)
+		fn()
+	}:
+		<-finished
+	case <-loop.done:
+		fn()
+	}
+}
+
+func (sm *HierarchicalStateMachine) runEvent(ctx context.Context, event string) error {
+	sm.runCtx = ctx
+	defer func() { sm.runCtx = nil }()
+	if event == "" {
+		return sm.Handle()
+	}
+	return sm.Dispatch(event).Err
+}
+
+// Awaits the async guards in order, stopping at the first that fails or errors
+func (sm *HierarchicalStateMachine) asyncGuardsPassed(transition *Transition) (bool, error) {
+	if len(transition.AsyncGuards) == 0 {
+		return true, nil
+	}
+	if sm.runCtx == nil {
+		return false, fmt.Errorf("transition from %q to %q: %w", stateName(transition.CurrentState), stateName(transition.NextState), ErrAsyncGuardOutsideRun)
+	}
+	for _, guard := range transition.AsyncGuards {
+		passed, err := guard(sm.runCtx)
+		if err != nil {
+			return false, fmt.Errorf("async guard on transition from %q to %q: %w", stateName(transition.CurrentState), stateName(transition.NextState), err)
+		}
+		if !passed {
+			return false, nil
+		}
+	}
+	return true, nil
+}
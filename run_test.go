@@ -0,0 +1,76 @@
+package hierarchicalStateMachine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunAsyncGuard(t *testing.T) {
+	pending := State{}
+	approved := State{}
+
+	resolved := make(chan bool, 1)
+	transitions := []Transition{
+		{
+			CurrentState: &pending,
+			EventName:    "approve",
+			AsyncGuards: []AsyncGuard{func(ctx context.Context) (bool, error) {
+				select {
+				case allowed := <-resolved:
+					return allowed, nil
+				case <-ctx.Done():
+					return false, ctx.Err()
+				}
+			}},
+			NextState: &approved,
+		},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&pending, []State{pending, approved}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check synchronous dispatch rejects the async guard
+	if result := sm.Dispatch("approve"); !errors.Is(result.Err, ErrAsyncGuardOutsideRun) {
+		t.Errorf("Expected error %v, got %v", ErrAsyncGuardOutsideRun, result.Err)
+	}
+	if sm.CurrentState != &pending {
+		t.Errorf("Expected current state to be %v, got %v", &pending, sm.CurrentState)
+	}
+
+	// Check Run awaits the guard resolving after a delay, then fires the transition
+	events := make(chan string)
+	done := make(chan error)
+	go func() { done <- sm.Run(context.Background(), events) }()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		resolved <- true
+	}()
+	events <- "approve"
+	close(events)
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if sm.CurrentState != &approved {
+		t.Errorf("Expected current state to be %v, got %v", &approved, sm.CurrentState)
+	}
+}
+
+func TestRunContextDone(t *testing.T) {
+	state1 := State{}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check Run stops with the context's error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sm.Run(ctx, make(chan string)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected error %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,53 @@
+package hierarchicalStateMachine
+
+import "math/rand"
+
+// FuzzDrive stress-tests the machine with steps random events. Each step picks one of the events
+// of the transitions that can leave the current state, a poll standing for the polled ones, and
+// dispatches it, then records the state the machine is in. Guards still apply, so a step may not
+// change the state. It returns the visited state names, starting with the current one, and stops
+// early once nothing can leave the current state, such as at a dead end where IsDeadEnd reports
+// true or when AcceptedEvents rejects every remaining event, so a sequence shorter than steps+1
+// means it got stuck. A given rng seed reproduces the same sequence.
+func (sm *HierarchicalStateMachine) FuzzDrive(rng *rand.Rand, steps int) []StateName {
+	visited := []StateName{sm.CurrentState.Name}
+	for i := 0; i < steps; i++ {
+		events, poll := sm.availableEvents()
+		candidates := len(events)
+		if poll {
+			candidates++
+		}
+		if candidates == 0 {
+			break
+		}
+
+		if pick := rng.Intn(candidates); pick < len(events) {
+			sm.SendEvent(events[pick])
+		} else {
+			sm.Handle()
+		}
+		visited = append(visited, sm.CurrentState.Name)
+	}
+	return visited
+}
+
+// Returns the event names of the transitions that can leave the current state in declaration
+// order, and whether any of them can be fired by polling
+func (sm *HierarchicalStateMachine) availableEvents() (events []string, poll bool) {
+	seen := map[string]bool{}
+	for i := range sm.transitions {
+		transition := &sm.transitions[i]
+		if !sm.leavesAtRest(transition, sm.CurrentState) {
+			continue
+		}
+		// Polls don't bubble
+		if leavesFrom(transition, sm.CurrentState) && (transition.EventName == "" || transition.Event != nil) {
+			poll = true
+		}
+		if name := transition.EventName; name != "" && !seen[name] && accepts(sm.CurrentState, name) {
+			seen[name] = true
+			events = append(events, name)
+		}
+	}
+	return events, poll
+}
@@ -0,0 +1,65 @@
+package hierarchicalStateMachine
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestFuzzDrive(t *testing.T) {
+	idle := State{Name: "idle"}
+	running := State{Name: "running"}
+	paused := State{Name: "paused"}
+
+	transitions := []Transition{
+		{CurrentState: &idle, EventName: "start", NextState: &running},
+		{CurrentState: &running, EventName: "pause", NextState: &paused},
+		{CurrentState: &running, EventName: "stop", NextState: &idle},
+		{CurrentState: &paused, EventName: "resume", NextState: &running},
+		{CurrentState: &paused, EventName: "stop", NextState: &idle},
+	}
+
+	newMachine := func() *HierarchicalStateMachine {
+		sm, err := NewHierarchicalStateMachine(&idle, []State{idle, running, paused}, transitions)
+		if err != nil {
+			t.Fatalf("failed to initialize state machine: %v", err)
+		}
+		return sm
+	}
+
+	// Check the same seed reproduces the same sequence
+	first := newMachine().FuzzDrive(rand.New(rand.NewSource(42)), 1000)
+	second := newMachine().FuzzDrive(rand.New(rand.NewSource(42)), 1000)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected the same sequence for the same seed")
+	}
+
+	// Check every step was taken and only declared states were visited
+	if len(first) != 1001 {
+		t.Errorf("Expected 1001 visited states, got %d", len(first))
+	}
+	for _, name := range first {
+		if name != "idle" && name != "running" && name != "paused" {
+			t.Errorf("Expected a declared state, got %q", name)
+		}
+	}
+}
+
+func TestFuzzDriveDeadEnd(t *testing.T) {
+	start := State{Name: "start"}
+	done := State{Name: "done"}
+
+	transitions := []Transition{{CurrentState: &start, EventName: "finish", NextState: &done}}
+
+	sm, err := NewHierarchicalStateMachine(&start, []State{start, done}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	// Check the drive stops at the dead end
+	visited := sm.FuzzDrive(rand.New(rand.NewSource(1)), 10)
+	expected := []StateName{"start", "done"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Expected visited states %v, got %v", expected, visited)
+	}
+}
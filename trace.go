@@ -0,0 +1,70 @@
+package hierarchicalStateMachine
+
+// GuardEval records how one transition was evaluated during a dispatch. Evaluation stops at the
+// first failing predicate, so each slice ends at the result that blocked the transition. Results
+// are recorded before InvertGuards is applied.
+type GuardEval struct {
+	Transition    *Transition
+	Event         bool     // Whether the event occurred; nothing else is evaluated when it didn't
+	Guards        []bool   // Results of Guards, in order
+	GuardGroups   [][]bool // Results of each evaluated GuardGroups group, stopping at the first that passed
+	VarGuards     []bool   // Results of VarGuards, in order
+	CheckedGuards []bool   // Results of CheckedGuards, false for an error
+}
+
+// LastGuardTrace returns the evaluations of the most recent HandleStateMachine or SendEvent call,
+// including dispatches queued by it. It is empty without WithGuardTrace.
+func (sm *HierarchicalStateMachine) LastGuardTrace() []GuardEval {
+	return append([]GuardEval(nil), sm.guardTrace...)
+}
+
+// Like evaluate, but records every result in the guard trace
+func (sm *HierarchicalStateMachine) evaluateTraced(transition *Transition, tr trigger) (occurred, passed bool, err error) {
+	eval := GuardEval{Transition: transition, Event: triggered(transition, tr)}
+	defer func() { sm.guardTrace = append(sm.guardTrace, eval) }()
+	if !eval.Event {
+		return false, false, nil
+	}
+
+	passed = tracePredicates(transition.Guards, &eval.Guards)
+	if passed && len(transition.GuardGroups) > 0 {
+		passed = false
+		for _, group := range transition.GuardGroups {
+			var results []bool
+			groupPassed := tracePredicates(group, &results)
+			eval.GuardGroups = append(eval.GuardGroups, results)
+			if groupPassed {
+				passed = true
+				break
+			}
+		}
+	}
+	if passed == transition.InvertGuards {
+		return true, false, nil
+	}
+	for _, condition := range transition.VarGuards {
+		holds := sm.varHolds(condition)
+		eval.VarGuards = append(eval.VarGuards, holds)
+		if !holds {
+			return true, false, nil
+		}
+	}
+
+	passed, err = checkedGuardsPassed(transition, &eval.CheckedGuards)
+	if passed {
+		passed, err = sm.asyncGuardsPassed(transition)
+	}
+	return true, passed, err
+}
+
+// Like allPredicatesPass, appending each result
+func tracePredicates(predicates []Predicate, results *[]bool) bool {
+	for _, predicate := range predicates {
+		passed := predicate()
+		*results = append(*results, passed)
+		if !passed {
+			return false
+		}
+	}
+	return true
+}
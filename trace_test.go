@@ -0,0 +1,41 @@
+package hierarchicalStateMachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGuardTrace(t *testing.T) {
+	state1 := State{}
+	state2 := State{}
+	state3 := State{}
+
+	transitions := []Transition{
+		{
+			CurrentState: &state1,
+			Event:        func() bool { return true },
+			Guards:       []Predicate{func() bool { return true }, func() bool { return false }, func() bool { return true }},
+			NextState:    &state2,
+		},
+		{CurrentState: &state1, Event: func() bool { return false }, NextState: &state3},
+		{CurrentState: &state2, NextState: &state3},
+	}
+
+	sm, err := NewHierarchicalStateMachine(&state1, []State{state1, state2, state3}, transitions, WithGuardTrace())
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	HandleStateMachine(sm)
+
+	// Check the passing event, the failing guard, and the transition whose event didn't occur
+	expected := []GuardEval{
+		{Transition: &sm.transitions[0], Event: true, Guards: []bool{true, false}},
+		{Transition: &sm.transitions[1], Event: false},
+	}
+	if trace := sm.LastGuardTrace(); !reflect.DeepEqual(trace, expected) {
+		t.Errorf("Expected guard trace %+v, got %+v", expected, trace)
+	}
+	if sm.LastHandleOutcome() != GuardBlocked {
+		t.Errorf("Expected outcome %v, got %v", GuardBlocked, sm.LastHandleOutcome())
+	}
+}
@@ -0,0 +1,218 @@
+package hierarchicalStateMachine
+
+import "fmt"
+
+// Severity ranks how serious a validation finding is
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// FindingCategory groups validation findings by the kind of problem
+type FindingCategory string
+
+const (
+	CategoryUnreachable FindingCategory = "unreachable" // No path of transitions leads to the state
+	CategoryOrphan      FindingCategory = "orphan"      // The state was declared but nothing references it
+	CategoryConflict    FindingCategory = "conflict"    // Two transitions from one state could both be eligible
+	CategoryEmpty       FindingCategory = "empty"       // The state has no actions and no transitions
+	CategoryDeadEnd     FindingCategory = "dead end"    // The state can be entered but never left
+	CategoryHierarchy   FindingCategory = "hierarchy"   // The ParentState chain or initial states are broken
+)
+
+type Finding struct {
+	Category    FindingCategory
+	Severity    Severity
+	Message     string
+	States      []*State
+	Transitions []*Transition
+}
+
+// ValidationReport collects every finding of Validate
+type ValidationReport struct {
+	Findings []Finding
+}
+
+// ByCategory returns the findings of one category
+func (r ValidationReport) ByCategory(category FindingCategory) []Finding {
+	var findings []Finding
+	for _, finding := range r.Findings {
+		if finding.Category == category {
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// HasErrors reports whether any finding has SeverityError
+func (r ValidationReport) HasErrors() bool {
+	for _, finding := range r.Findings {
+		if finding.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the whole model at once and reports unreachable, orphaned, empty and dead-end
+// states, conflicting transitions and broken hierarchies. Guards are ignored.
+func (sm *HierarchicalStateMachine) Validate() ValidationReport {
+	var report ValidationReport
+	add := func(category FindingCategory, severity Severity, message string, states []*State, transitions []*Transition) {
+		report.Findings = append(report.Findings, Finding{category, severity, message, states, transitions})
+	}
+	states := sm.States()
+
+	// Hierarchy problems come first since the other checks walk the hierarchy
+	broken := map[*State]bool{}
+	for _, state := range states {
+		if state.Depth() >= MaxStates {
+			broken[state] = true
+			add(CategoryHierarchy, SeverityError, fmt.Sprintf("state %s has a cyclic or too deep ParentState chain", stateLabel(states, state)), []*State{state}, nil)
+		} else if err := validateInitial(state); err != nil {
+			broken[state] = true
+			add(CategoryHierarchy, SeverityError, err.Error(), []*State{state}, nil)
+		}
+	}
+
+	reachable := sm.reachableStates(broken)
+	for _, state := range states {
+		if !reachable[state] && !broken[state] {
+			add(CategoryUnreachable, SeverityWarning, fmt.Sprintf("state %s can't be reached from the initial state", stateLabel(states, state)), []*State{state}, nil)
+		}
+	}
+
+	known := map[StateName]bool{}
+	for _, state := range states {
+		known[state.Name] = true
+	}
+	for i := range sm.states {
+		if name := sm.states[i].Name; name != "" && !known[name] {
+			add(CategoryOrphan, SeverityWarning, fmt.Sprintf("state %s is declared but never referenced", name), []*State{&sm.states[i]}, nil)
+		}
+	}
+
+	for i := range sm.transitions {
+		for j := i + 1; j < len(sm.transitions); j++ {
+			a, b := &sm.transitions[i], &sm.transitions[j]
+			if a.CurrentState == b.CurrentState && sameTrigger(a, b) {
+				add(CategoryConflict, SeverityWarning, fmt.Sprintf("transitions %d and %d from state %s could both be eligible", i, j, stateLabel(states, a.CurrentState)), []*State{a.CurrentState}, []*Transition{a, b})
+			}
+		}
+	}
+
+	for _, state := range sm.EmptyStates() {
+		add(CategoryEmpty, SeverityInfo, fmt.Sprintf("state %s has no actions and no transitions", stateLabel(states, state)), []*State{state}, nil)
+	}
+
+	for _, state := range states {
+		if reachable[state] && sm.canBeCurrent(state) && !sm.hasEdgeFrom(state) {
+			add(CategoryDeadEnd, SeverityInfo, fmt.Sprintf("state %s has no outgoing transitions", stateLabel(states, state)), []*State{state}, nil)
+		}
+	}
+
+	return report
+}
+
+// Returns the states that can be entered from the initial state, ignoring guards
+func (sm *HierarchicalStateMachine) reachableStates(broken map[*State]bool) map[*State]bool {
+	reachable := map[*State]bool{}
+	var queue []*State
+	enter := func(state *State) {
+		for _, settled := range possibleSettles(state) {
+			if reachable[settled] {
+				continue
+			}
+			queue = append(queue, settled)
+			for s, depth := settled, 0; s != nil && depth < MaxStates; s, depth = s.ParentState, depth+1 {
+				reachable[s] = true
+			}
+		}
+	}
+
+	if sm.initialState != nil && !broken[sm.initialState] {
+		enter(sm.initialState)
+	}
+	if sm.guardErrorPolicy == GuardErrorRoute && !broken[sm.errorState] {
+		enter(sm.errorState)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for i := range sm.transitions {
+			transition := &sm.transitions[i]
+			if sm.canLeave(transition, state) && transition.NextState != nil && !broken[transition.NextState] {
+				enter(transition.NextState)
+			}
+		}
+	}
+	return reachable
+}
+
+// Like hasOutgoing, but counting OnEntry transitions too, which always leave the state when guards
+// are ignored
+func (sm *HierarchicalStateMachine) hasEdgeFrom(state *State) bool {
+	for i := range sm.transitions {
+		if sm.canLeave(&sm.transitions[i], state) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns every state the machine could settle in when entering the state, ignoring guards
+func possibleSettles(state *State) []*State {
+	if state.Initial == nil {
+		return []*State{state}
+	}
+	settles := possibleSettles(state.Initial)
+	for _, choice := range state.InitialChoices {
+		settles = append(settles, possibleSettles(choice.State)...)
+	}
+	return settles
+}
+
+// A state can be current when it is the initial state or a transition target without initial states
+func (sm *HierarchicalStateMachine) canBeCurrent(state *State) bool {
+	if state.Initial != nil {
+		return false
+	}
+	if state == sm.initialState || state == sm.errorState {
+		return true
+	}
+	for i := range sm.transitions {
+		if sm.transitions[i].NextState == state {
+			return true
+		}
+	}
+	return isInitialOfParent(state)
+}
+
+func isInitialOfParent(state *State) bool {
+	for parent, depth := state.ParentState, 0; parent != nil && depth < MaxStates; parent, depth = parent.ParentState, depth+1 {
+		if parent.Initial == state {
+			return true
+		}
+		for _, choice := range parent.InitialChoices {
+			if choice.State == state {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package hierarchicalStateMachine
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	stateA := State{Name: "a", Entry: []Action{func() {}}}
+	stateB := State{Name: "b", Entry: []Action{func() {}}}
+	stateC := State{Name: "c", Entry: []Action{func() {}}}
+	stateD := State{Name: "d", Entry: []Action{func() {}}}
+	stateE := State{Name: "e", Entry: []Action{func() {}}}
+	cycle1 := State{Name: "cycle1"}
+	cycle2 := State{Name: "cycle2", ParentState: &cycle1}
+	cycle1.ParentState = &cycle2
+
+	transitions := []Transition{
+		{CurrentState: &stateA, EventName: "go", NextState: &stateB},
+		{CurrentState: &stateA, EventName: "go", NextState: &stateC}, // Conflicts with the transition above
+		{CurrentState: &stateB, EventName: "back", NextState: &stateA},
+		{CurrentState: &stateD, EventName: "go", NextState: &stateA},   // d is never entered
+		{CurrentState: &stateD, EventName: "loop", NextState: &cycle2}, // cycle2 has a cyclic hierarchy
+	}
+
+	sm, err := NewHierarchicalStateMachine(&stateA, []State{stateA, stateB, stateC, stateD, stateE, cycle1, cycle2}, transitions)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+
+	report := sm.Validate()
+
+	expected := map[FindingCategory]int{
+		CategoryUnreachable: 1, // d
+		CategoryOrphan:      1, // e
+		CategoryConflict:    1, // a on go
+		CategoryDeadEnd:     1, // c
+		CategoryHierarchy:   2, // cycle1 and cycle2
+	}
+	for category, count := range expected {
+		if findings := report.ByCategory(category); len(findings) != count {
+			t.Errorf("Expected %d %s findings, got %v", count, category, findings)
+		}
+	}
+	if !report.HasErrors() {
+		t.Errorf("Expected the hierarchy cycle to be reported as an error")
+	}
+
+	// Check an empty state is reported
+	bare := State{}
+	sm, err = NewHierarchicalStateMachine(&bare, []State{bare}, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize state machine: %v", err)
+	}
+	if findings := sm.Validate().ByCategory(CategoryEmpty); len(findings) != 1 {
+		t.Errorf("Expected 1 empty finding, got %v", findings)
+	}
+}